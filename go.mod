@@ -24,7 +24,7 @@ require (
 	github.com/mattn/go-sqlite3 v1.9.0 // indirect
 	github.com/micromdm/go4 v0.0.0-20191221011012-654e10aaab18
 	github.com/micromdm/scep v1.0.1-0.20181014170139-9be65e185499
-	github.com/pkg/errors v0.8.0
+	github.com/pkg/errors v0.9.1
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	github.com/pressly/goose v2.3.0+incompatible
 	github.com/stretchr/testify v1.2.2 // indirect
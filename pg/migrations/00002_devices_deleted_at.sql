@@ -0,0 +1,6 @@
+-- +goose Up
+ALTER TABLE devices ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMPTZ;
+
+
+-- +goose Down
+ALTER TABLE devices DROP COLUMN IF EXISTS deleted_at;
@@ -0,0 +1,6 @@
+-- +goose Up
+ALTER TABLE devices ADD COLUMN IF NOT EXISTS workflow_uuid TEXT DEFAULT '';
+
+
+-- +goose Down
+ALTER TABLE devices DROP COLUMN IF EXISTS workflow_uuid;
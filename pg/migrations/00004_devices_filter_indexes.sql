@@ -0,0 +1,10 @@
+-- +goose Up
+CREATE INDEX IF NOT EXISTS devices_dep_profile_status_idx ON devices (dep_profile_status);
+CREATE INDEX IF NOT EXISTS devices_model_idx ON devices (model);
+CREATE INDEX IF NOT EXISTS devices_workflow_uuid_idx ON devices (workflow_uuid);
+
+
+-- +goose Down
+DROP INDEX IF EXISTS devices_dep_profile_status_idx;
+DROP INDEX IF EXISTS devices_model_idx;
+DROP INDEX IF EXISTS devices_workflow_uuid_idx;
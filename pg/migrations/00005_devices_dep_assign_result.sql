@@ -0,0 +1,8 @@
+-- +goose Up
+ALTER TABLE devices ADD COLUMN IF NOT EXISTS dep_assign_error TEXT DEFAULT '';
+ALTER TABLE devices ADD COLUMN IF NOT EXISTS dep_assign_attempts INTEGER DEFAULT 0;
+
+
+-- +goose Down
+ALTER TABLE devices DROP COLUMN IF EXISTS dep_assign_attempts;
+ALTER TABLE devices DROP COLUMN IF EXISTS dep_assign_error;
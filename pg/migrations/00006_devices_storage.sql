@@ -0,0 +1,8 @@
+-- +goose Up
+ALTER TABLE devices ADD COLUMN IF NOT EXISTS total_storage BIGINT DEFAULT 0;
+ALTER TABLE devices ADD COLUMN IF NOT EXISTS available_storage BIGINT DEFAULT 0;
+
+
+-- +goose Down
+ALTER TABLE devices DROP COLUMN IF EXISTS available_storage;
+ALTER TABLE devices DROP COLUMN IF EXISTS total_storage;
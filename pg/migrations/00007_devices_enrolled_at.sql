@@ -0,0 +1,8 @@
+-- +goose Up
+ALTER TABLE devices ADD COLUMN IF NOT EXISTS enrolled_at TIMESTAMPTZ;
+CREATE INDEX IF NOT EXISTS devices_enrolled_at_idx ON devices (enrolled_at);
+
+
+-- +goose Down
+DROP INDEX IF EXISTS devices_enrolled_at_idx;
+ALTER TABLE devices DROP COLUMN IF EXISTS enrolled_at;
@@ -0,0 +1,8 @@
+-- +goose Up
+CREATE INDEX IF NOT EXISTS devices_imei_idx ON devices (imei);
+CREATE INDEX IF NOT EXISTS devices_meid_idx ON devices (meid);
+
+
+-- +goose Down
+DROP INDEX IF EXISTS devices_imei_idx;
+DROP INDEX IF EXISTS devices_meid_idx;
@@ -0,0 +1,26 @@
+-- +goose Up
+ALTER TABLE devices ADD COLUMN IF NOT EXISTS created_at TIMESTAMPTZ NOT NULL DEFAULT now();
+ALTER TABLE devices ADD COLUMN IF NOT EXISTS updated_at TIMESTAMPTZ NOT NULL DEFAULT now();
+CREATE INDEX IF NOT EXISTS devices_updated_at_idx ON devices (updated_at);
+
+-- +goose StatementBegin
+CREATE OR REPLACE FUNCTION devices_set_updated_at() RETURNS TRIGGER AS $$
+BEGIN
+    NEW.updated_at = now();
+    NEW.created_at = OLD.created_at;
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+-- +goose StatementEnd
+
+DROP TRIGGER IF EXISTS devices_set_updated_at ON devices;
+CREATE TRIGGER devices_set_updated_at BEFORE UPDATE ON devices
+    FOR EACH ROW EXECUTE PROCEDURE devices_set_updated_at();
+
+
+-- +goose Down
+DROP TRIGGER IF EXISTS devices_set_updated_at ON devices;
+DROP FUNCTION IF EXISTS devices_set_updated_at();
+DROP INDEX IF EXISTS devices_updated_at_idx;
+ALTER TABLE devices DROP COLUMN IF EXISTS updated_at;
+ALTER TABLE devices DROP COLUMN IF EXISTS created_at;
@@ -0,0 +1,11 @@
+-- +goose Up
+CREATE TABLE IF NOT EXISTS device_tags (
+    device_uuid TEXT NOT NULL REFERENCES devices (uuid) ON DELETE CASCADE,
+    tag TEXT NOT NULL,
+    PRIMARY KEY (device_uuid, tag)
+);
+CREATE INDEX IF NOT EXISTS device_tags_tag_idx ON device_tags (tag);
+
+
+-- +goose Down
+DROP TABLE IF EXISTS device_tags;
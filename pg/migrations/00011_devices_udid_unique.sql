@@ -0,0 +1,7 @@
+-- +goose Up
+-- DEP devices are saved before they enroll and have an empty udid, so only set udids are unique.
+CREATE UNIQUE INDEX IF NOT EXISTS devices_udid_key ON devices (udid) WHERE udid <> '';
+
+
+-- +goose Down
+DROP INDEX IF EXISTS devices_udid_key;
@@ -0,0 +1,10 @@
+-- +goose Up
+ALTER TABLE devices ADD COLUMN IF NOT EXISTS last_push_at TIMESTAMPTZ;
+ALTER TABLE devices ADD COLUMN IF NOT EXISTS last_push_error TEXT DEFAULT '';
+CREATE INDEX IF NOT EXISTS devices_last_push_at_idx ON devices (last_push_at);
+
+
+-- +goose Down
+DROP INDEX IF EXISTS devices_last_push_at_idx;
+ALTER TABLE devices DROP COLUMN IF EXISTS last_push_error;
+ALTER TABLE devices DROP COLUMN IF EXISTS last_push_at;
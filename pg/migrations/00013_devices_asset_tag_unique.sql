@@ -0,0 +1,7 @@
+-- +goose Up
+-- most devices have no asset tag, so only set asset tags are unique.
+CREATE UNIQUE INDEX IF NOT EXISTS devices_asset_tag_key ON devices (asset_tag) WHERE asset_tag <> '';
+
+
+-- +goose Down
+DROP INDEX IF EXISTS devices_asset_tag_key;
@@ -0,0 +1,37 @@
+-- +goose Up
+CREATE TABLE IF NOT EXISTS dep_assignment_history (
+    id BIGSERIAL PRIMARY KEY,
+    device_uuid TEXT NOT NULL REFERENCES devices (uuid) ON DELETE CASCADE,
+    profile_uuid TEXT NOT NULL,
+    assigned_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    assigned_by TEXT NOT NULL DEFAULT ''
+);
+CREATE INDEX IF NOT EXISTS dep_assignment_history_device_uuid_idx ON dep_assignment_history (device_uuid, assigned_at);
+
+-- the history table is looked up in the schema of the devices table, so that it works with WithSchema.
+-- +goose StatementBegin
+CREATE OR REPLACE FUNCTION devices_record_dep_assignment() RETURNS TRIGGER AS $$
+BEGIN
+    EXECUTE format('INSERT INTO %I.dep_assignment_history (device_uuid, profile_uuid, assigned_by) VALUES ($1, $2, $3)', TG_TABLE_SCHEMA)
+        USING NEW.uuid, NEW.dep_profile_uuid, COALESCE(NEW.dep_profile_assigned_by, '');
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+-- +goose StatementEnd
+
+DROP TRIGGER IF EXISTS devices_record_dep_assignment_insert ON devices;
+CREATE TRIGGER devices_record_dep_assignment_insert AFTER INSERT ON devices
+    FOR EACH ROW WHEN (NEW.dep_profile_uuid <> '')
+    EXECUTE PROCEDURE devices_record_dep_assignment();
+
+DROP TRIGGER IF EXISTS devices_record_dep_assignment_update ON devices;
+CREATE TRIGGER devices_record_dep_assignment_update AFTER UPDATE OF dep_profile_uuid ON devices
+    FOR EACH ROW WHEN (NEW.dep_profile_uuid <> '' AND NEW.dep_profile_uuid IS DISTINCT FROM OLD.dep_profile_uuid)
+    EXECUTE PROCEDURE devices_record_dep_assignment();
+
+
+-- +goose Down
+DROP TRIGGER IF EXISTS devices_record_dep_assignment_update ON devices;
+DROP TRIGGER IF EXISTS devices_record_dep_assignment_insert ON devices;
+DROP FUNCTION IF EXISTS devices_record_dep_assignment();
+DROP TABLE IF EXISTS dep_assignment_history;
@@ -0,0 +1,6 @@
+-- +goose Up
+ALTER TABLE devices ADD COLUMN IF NOT EXISTS push_claimed_at TIMESTAMPTZ;
+
+
+-- +goose Down
+ALTER TABLE devices DROP COLUMN IF EXISTS push_claimed_at;
@@ -0,0 +1,11 @@
+-- +goose Up
+-- serial numbers are compared the way Save normalizes them, so that differently cased or padded
+-- serials cannot be saved as two devices. DEP devices are found by serial, which is empty for some
+-- manually enrolled devices, and a soft deleted device may enroll again under a new uuid.
+-- Existing duplicates must be merged first, see FindDuplicateSerials and MergeDevices.
+CREATE UNIQUE INDEX IF NOT EXISTS devices_serial_number_key ON devices (upper(btrim(serial_number)))
+    WHERE serial_number <> '' AND deleted_at IS NULL;
+
+
+-- +goose Down
+DROP INDEX IF EXISTS devices_serial_number_key;
@@ -0,0 +1,14 @@
+-- +goose Up
+-- DEP leaves out profile times it does not know; store them as NULL rather than a placeholder date.
+ALTER TABLE devices ALTER COLUMN dep_profile_assign_time DROP DEFAULT;
+ALTER TABLE devices ALTER COLUMN dep_profile_push_time DROP DEFAULT;
+ALTER TABLE devices ALTER COLUMN dep_profile_assigned_date DROP DEFAULT;
+UPDATE devices SET dep_profile_assign_time = NULL WHERE dep_profile_assign_time <= '1970-01-01';
+UPDATE devices SET dep_profile_push_time = NULL WHERE dep_profile_push_time <= '1970-01-01';
+UPDATE devices SET dep_profile_assigned_date = NULL WHERE dep_profile_assigned_date <= '1970-01-01';
+
+
+-- +goose Down
+ALTER TABLE devices ALTER COLUMN dep_profile_assign_time SET DEFAULT '1970-01-01 00:00:00';
+ALTER TABLE devices ALTER COLUMN dep_profile_push_time SET DEFAULT '1970-01-01 00:00:00';
+ALTER TABLE devices ALTER COLUMN dep_profile_assigned_date SET DEFAULT '1970-01-01 00:00:00';
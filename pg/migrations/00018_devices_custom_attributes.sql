@@ -0,0 +1,6 @@
+-- +goose Up
+ALTER TABLE devices ADD COLUMN IF NOT EXISTS custom_attributes JSONB NOT NULL DEFAULT '{}';
+
+
+-- +goose Down
+ALTER TABLE devices DROP COLUMN IF EXISTS custom_attributes;
@@ -0,0 +1,9 @@
+-- +goose Up
+-- a soft deleted device may enroll again under a new uuid, so its udid is no longer reserved.
+DROP INDEX IF EXISTS devices_udid_key;
+CREATE UNIQUE INDEX devices_udid_key ON devices (udid) WHERE udid <> '' AND deleted_at IS NULL;
+
+
+-- +goose Down
+DROP INDEX IF EXISTS devices_udid_key;
+CREATE UNIQUE INDEX devices_udid_key ON devices (udid) WHERE udid <> '';
@@ -0,0 +1,9 @@
+-- +goose Up
+-- the asset tag of a soft deleted device can be given to another device.
+DROP INDEX IF EXISTS devices_asset_tag_key;
+CREATE UNIQUE INDEX devices_asset_tag_key ON devices (asset_tag) WHERE asset_tag <> '' AND deleted_at IS NULL;
+
+
+-- +goose Down
+DROP INDEX IF EXISTS devices_asset_tag_key;
+CREATE UNIQUE INDEX devices_asset_tag_key ON devices (asset_tag) WHERE asset_tag <> '';
@@ -0,0 +1,31 @@
+-- +goose Up
+-- recording a push is not a change of the device, so that ModifiedSince does not report
+-- every pushed device. Updates which only change the push bookkeeping columns keep updated_at.
+-- +goose StatementBegin
+CREATE OR REPLACE FUNCTION devices_set_updated_at() RETURNS TRIGGER AS $$
+DECLARE
+    -- the push bookkeeping columns, and the timestamps maintained by this trigger.
+    ignored TEXT[] := ARRAY['last_push_at', 'last_push_error', 'push_claimed_at', 'updated_at', 'created_at'];
+BEGIN
+    IF to_jsonb(NEW) - ignored = to_jsonb(OLD) - ignored AND to_jsonb(NEW) <> to_jsonb(OLD) THEN
+        NEW.updated_at = OLD.updated_at;
+    ELSE
+        NEW.updated_at = now();
+    END IF;
+    NEW.created_at = OLD.created_at;
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+-- +goose StatementEnd
+
+
+-- +goose Down
+-- +goose StatementBegin
+CREATE OR REPLACE FUNCTION devices_set_updated_at() RETURNS TRIGGER AS $$
+BEGIN
+    NEW.updated_at = now();
+    NEW.created_at = OLD.created_at;
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+-- +goose StatementEnd
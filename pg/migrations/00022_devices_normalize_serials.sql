@@ -0,0 +1,11 @@
+-- +goose Up
+-- serial numbers saved before Save normalized them still match devices_serial_number_key,
+-- but not the normalized serial a lookup compares with. Storing them normalized lets
+-- DeviceBySerial and the SerialNumber filter find them. The unique index guarantees that
+-- no two devices which are not deleted have the same normalized serial.
+UPDATE devices SET serial_number = upper(btrim(serial_number))
+    WHERE serial_number <> upper(btrim(serial_number));
+
+
+-- +goose Down
+-- the original spelling of the serial numbers is not kept.
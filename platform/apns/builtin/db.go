@@ -75,3 +75,15 @@ func (db *DB) Save(ctx context.Context, info *apns.PushInfo) error {
 	}
 	return tx.Commit()
 }
+
+// Delete deletes the push info of udid. Deleting missing push info is not an error.
+func (db *DB) Delete(ctx context.Context, udid string) error {
+	err := db.Update(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket([]byte(PushBucket))
+		if bkt == nil {
+			return fmt.Errorf("bucket %q not found!", PushBucket)
+		}
+		return bkt.Delete([]byte(udid))
+	})
+	return errors.Wrap(err, "delete PushInfo from boltdb")
+}
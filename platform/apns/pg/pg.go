@@ -80,6 +80,19 @@ func (d *Postgres) PushInfo(ctx context.Context, udid string) (*apns.PushInfo, e
 	return &i, errors.Wrap(err, "finding push_info by udid")
 }
 
+// Delete deletes the push info of udid. Deleting missing push info is not an error.
+func (d *Postgres) Delete(ctx context.Context, udid string) error {
+	query, args, err := sq.StatementBuilder.PlaceholderFormat(sq.Dollar).
+		Delete(tableName).
+		Where(sq.Eq{"udid": udid}).
+		ToSql()
+	if err != nil {
+		return errors.Wrap(err, "building sql")
+	}
+	_, err = d.db.ExecContext(ctx, query, args...)
+	return errors.Wrap(err, "exec push_info delete in pg")
+}
+
 type pushInfoNotFoundErr struct{}
 
 func (e pushInfoNotFoundErr) Error() string  { return "push_info not found" }
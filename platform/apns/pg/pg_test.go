@@ -33,6 +33,58 @@ func TestPGCrud(t *testing.T) {
 	}
 }
 
+func TestSaveOverwritesPushInfo(t *testing.T) {
+	db := setup(t)
+	ctx := context.Background()
+
+	first := apns.PushInfo{
+		UDID:      "UDID-token-update",
+		Token:     "tok-1",
+		PushMagic: "magic-1",
+		MDMTopic:  "com.apple.mgmt.External.1",
+	}
+	if err := db.Save(ctx, &first); err != nil {
+		t.Fatal(err)
+	}
+
+	second := apns.PushInfo{
+		UDID:      first.UDID,
+		Token:     "tok-2",
+		PushMagic: "magic-2",
+		MDMTopic:  "com.apple.mgmt.External.2",
+	}
+	if err := db.Save(ctx, &second); err != nil {
+		t.Fatal(err)
+	}
+
+	found, err := db.PushInfo(ctx, first.UDID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := *found, second; have != want {
+		t.Errorf("have %+v, want %+v", have, want)
+	}
+}
+
+func TestDeletePushInfo(t *testing.T) {
+	db := setup(t)
+	ctx := context.Background()
+
+	info := apns.PushInfo{UDID: "UDID-checkout", Token: "tok", PushMagic: "magic", MDMTopic: "com.apple.mgmt.External.1"}
+	if err := db.Save(ctx, &info); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete(ctx, info.UDID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.PushInfo(ctx, info.UDID); err == nil {
+		t.Error("expected an error finding deleted push info")
+	}
+	if err := db.Delete(ctx, info.UDID); err != nil {
+		t.Errorf("deleting missing push info: %v", err)
+	}
+}
+
 func setup(t *testing.T) *Postgres {
 	db, err := dbutil.OpenDBX(
 		"postgres",
@@ -61,6 +61,15 @@ func (svc *PushService) Push(ctx context.Context, deviceUDID string, opts ...Pus
 	}
 
 	result, err := svc.pushsvc.Push(info.Token, headers, jsonPayload)
+	if DeviceTokenInvalid(err) {
+		// APNs will not deliver to the token again, so forget it until the device sends a new one.
+		if store, ok := svc.store.(pushInfoDeleter); ok {
+			if derr := store.Delete(ctx, deviceUDID); derr != nil {
+				return result, errors.Wrapf(derr, "deleting push info with invalid token after %s", err)
+			}
+		}
+		return result, err
+	}
 	if err != nil && strings.HasSuffix(err.Error(), "remote error: tls: internal error") {
 		// TODO: yuck, error substring searching. see:
 		// https://github.com/micromdm/micromdm/issues/150
@@ -69,6 +78,24 @@ func (svc *PushService) Push(ctx context.Context, deviceUDID string, opts ...Pus
 	return result, err
 }
 
+// pushInfoDeleter is implemented by stores which Push can delete the push info of
+// a device with an invalid token from.
+type pushInfoDeleter interface {
+	Delete(ctx context.Context, udid string) error
+}
+
+// DeviceTokenInvalid reports whether err is an APNs response saying the device token
+// can no longer be used: 410 Unregistered or 400 BadDeviceToken.
+// Devices for which this is true should be treated as checked out.
+// Push deletes the push info of such a device if its store can delete push info.
+func DeviceTokenInvalid(err error) bool {
+	perr, ok := errors.Cause(err).(*push.Error)
+	if !ok {
+		return false
+	}
+	return perr.Reason == push.ErrUnregistered || perr.Reason == push.ErrBadDeviceToken
+}
+
 type pushRequest struct {
 	UDID     string
 	expireAt time.Time
@@ -0,0 +1,82 @@
+package apns
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/RobotsAndPencils/buford/push"
+	"github.com/pkg/errors"
+)
+
+func TestDeviceTokenInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"unregistered", &push.Error{Reason: push.ErrUnregistered, Status: http.StatusGone}, true},
+		{"bad device token", &push.Error{Reason: push.ErrBadDeviceToken, Status: http.StatusBadRequest}, true},
+		{"wrapped", errors.Wrap(&push.Error{Reason: push.ErrUnregistered, Status: http.StatusGone}, "push"), true},
+		{"bad topic", &push.Error{Reason: push.ErrBadTopic, Status: http.StatusBadRequest}, false},
+		{"other error", errors.New("connection reset"), false},
+		{"nil", nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if have, want := DeviceTokenInvalid(tt.err), tt.want; have != want {
+				t.Errorf("have %v, want %v", have, want)
+			}
+		})
+	}
+}
+
+func TestPushInvalidDeviceToken(t *testing.T) {
+	const token = "c2732227a1d8021cfaf781d71fb2f908c61f5861079a00954a5453f1d0281433"
+	tests := []struct {
+		name     string
+		status   int
+		body     string
+		wantKept bool
+	}{
+		{"unregistered", http.StatusGone, `{"reason":"Unregistered","timestamp":1583064000000}`, false},
+		{"bad device token", http.StatusBadRequest, `{"reason":"BadDeviceToken"}`, false},
+		{"bad topic", http.StatusBadRequest, `{"reason":"BadTopic"}`, true},
+		{"delivered", http.StatusOK, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.ProtoMajor != 2 {
+					t.Errorf("push sent over %s, want HTTP/2", r.Proto)
+				}
+				if have, want := r.URL.Path, "/3/device/"+token; have != want {
+					t.Errorf("have path %s, want %s", have, want)
+				}
+				w.Header().Set("apns-id", "push-id")
+				w.WriteHeader(tt.status)
+				_, _ = w.Write([]byte(tt.body))
+			}))
+			srv.EnableHTTP2 = true
+			srv.StartTLS()
+			defer srv.Close()
+
+			db := &memWorkerStore{infos: map[string]PushInfo{
+				"UDID-push": {UDID: "UDID-push", Token: token, PushMagic: "magic", MDMTopic: "com.apple.mgmt.External.1"},
+			}}
+			svc := &PushService{store: db, pushsvc: push.NewService(srv.Client(), srv.URL)}
+
+			_, err := svc.Push(context.Background(), "UDID-push")
+			if have, want := err == nil, tt.status == http.StatusOK; have != want {
+				t.Fatalf("push error: %v", err)
+			}
+			if have, want := DeviceTokenInvalid(err), !tt.wantKept; have != want {
+				t.Errorf("DeviceTokenInvalid(%v): have %v, want %v", err, have, want)
+			}
+			if _, kept := db.infos["UDID-push"]; kept != tt.wantKept {
+				t.Errorf("push info kept: have %v, want %v", kept, tt.wantKept)
+			}
+		})
+	}
+}
@@ -13,6 +13,7 @@ import (
 
 type WorkerStore interface {
 	Save(context.Context, *PushInfo) error
+	Delete(ctx context.Context, udid string) error
 }
 
 type Worker struct {
@@ -36,6 +37,11 @@ func (w *Worker) Run(ctx context.Context) error {
 		return errors.Wrapf(err,
 			"subscribing %s to %s topic", subscription, mdm.TokenUpdateTopic)
 	}
+	checkoutEvents, err := w.sub.Subscribe(ctx, subscription, mdm.CheckoutTopic)
+	if err != nil {
+		return errors.Wrapf(err,
+			"subscribing %s to %s topic", subscription, mdm.CheckoutTopic)
+	}
 
 	for {
 		var err error
@@ -44,6 +50,8 @@ func (w *Worker) Run(ctx context.Context) error {
 			return ctx.Err()
 		case event := <-tokenUpdateEvents:
 			err = w.updatePushInfoFromTokenUpdate(ctx, event.Message)
+		case event := <-checkoutEvents:
+			err = w.deletePushInfoFromCheckout(ctx, event.Message)
 		}
 		if err != nil {
 			level.Info(w.logger).Log(
@@ -61,20 +69,41 @@ func (w *Worker) updatePushInfoFromTokenUpdate(ctx context.Context, message []by
 		return errors.Wrap(err, "unmarshal pushinfo event")
 	}
 	info := PushInfo{
-		UDID:      ev.Command.UDID,
+		UDID:      pushInfoKey(ev.Command),
 		Token:     ev.Command.Token.String(),
 		PushMagic: ev.Command.PushMagic,
 		MDMTopic:  ev.Command.Topic,
 	}
-	// UDID is the primary key for storing the APNS values.
-	// For MDM managed users, use the UserID instead,
-	// and for BYOD User Enrollment, use the EnrollmentID.
-	if ev.Command.UserID != "" {
-		info.UDID = ev.Command.UserID
-	}
-	if ev.Command.EnrollmentID != "" {
-		info.UDID = ev.Command.EnrollmentID
+	if info.Token == "" || info.PushMagic == "" || info.MDMTopic == "" {
+		return errors.Errorf("incomplete push credentials in TokenUpdate for udid=%s", info.UDID)
 	}
 	err := w.db.Save(ctx, &info)
 	return errors.Wrapf(err, "saving pushinfo for udid=%s", info.UDID)
 }
+
+// deletePushInfoFromCheckout deletes the push info of a device when it checks out,
+// so that pushes to it fail instead of being sent with its stale token.
+func (w *Worker) deletePushInfoFromCheckout(ctx context.Context, message []byte) error {
+	var ev mdm.CheckinEvent
+	if err := mdm.UnmarshalCheckinEvent(message, &ev); err != nil {
+		return errors.Wrap(err, "unmarshal checkout event")
+	}
+	udid := pushInfoKey(ev.Command)
+	err := w.db.Delete(ctx, udid)
+	return errors.Wrapf(err, "deleting pushinfo for udid=%s", udid)
+}
+
+// pushInfoKey returns the key push info is stored under.
+// UDID is the primary key for storing the APNS values.
+// For MDM managed users, use the UserID instead,
+// and for BYOD User Enrollment, use the EnrollmentID.
+func pushInfoKey(cmd mdm.CheckinCommand) string {
+	key := cmd.UDID
+	if cmd.UserID != "" {
+		key = cmd.UserID
+	}
+	if cmd.EnrollmentID != "" {
+		key = cmd.EnrollmentID
+	}
+	return key
+}
@@ -0,0 +1,101 @@
+package apns
+
+import (
+	"context"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+
+	"github.com/micromdm/micromdm/mdm"
+)
+
+func TestDeletePushInfoFromCheckout(t *testing.T) {
+	db := &memWorkerStore{infos: map[string]PushInfo{
+		"UDID-checkout": {UDID: "UDID-checkout", Token: "abcdef", PushMagic: "magic", MDMTopic: "com.apple.mgmt.External.1"},
+		"UDID-other":    {UDID: "UDID-other", Token: "123456", PushMagic: "magic", MDMTopic: "com.apple.mgmt.External.1"},
+	}}
+	w := NewWorker(db, nil, log.NewNopLogger())
+
+	message, err := mdm.MarshalCheckinEvent(&mdm.CheckinEvent{
+		Command: mdm.CheckinCommand{MessageType: "CheckOut", UDID: "UDID-checkout"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.deletePushInfoFromCheckout(context.Background(), message); err != nil {
+		t.Fatal(err)
+	}
+
+	if info, ok := db.infos["UDID-checkout"]; ok {
+		t.Errorf("push info kept after checkout: %+v", info)
+	}
+	if _, ok := db.infos["UDID-other"]; !ok {
+		t.Error("checkout deleted the push info of another device")
+	}
+}
+
+func TestIncompleteTokenUpdateKeepsPushInfo(t *testing.T) {
+	saved := PushInfo{UDID: "UDID-token", Token: "abcdef", PushMagic: "magic", MDMTopic: "com.apple.mgmt.External.1"}
+	db := &memWorkerStore{infos: map[string]PushInfo{saved.UDID: saved}}
+	w := NewWorker(db, nil, log.NewNopLogger())
+
+	update := func(token []byte, pushMagic, topic string) error {
+		cmd := mdm.CheckinCommand{MessageType: "TokenUpdate", UDID: saved.UDID, Topic: topic}
+		cmd.Token = token
+		cmd.PushMagic = pushMagic
+		message, err := mdm.MarshalCheckinEvent(&mdm.CheckinEvent{Command: cmd})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return w.updatePushInfoFromTokenUpdate(context.Background(), message)
+	}
+
+	for _, tt := range []struct {
+		name             string
+		token            []byte
+		pushMagic, topic string
+	}{
+		{"no token", nil, "magic-2", "com.apple.mgmt.External.2"},
+		{"no push magic", []byte{0x12, 0x34}, "", "com.apple.mgmt.External.2"},
+		{"no topic", []byte{0x12, 0x34}, "magic-2", ""},
+	} {
+		if err := update(tt.token, tt.pushMagic, tt.topic); err == nil {
+			t.Errorf("%s: expected an error", tt.name)
+		}
+		if have := db.infos[saved.UDID]; have != saved {
+			t.Errorf("%s: push info overwritten with %+v", tt.name, have)
+		}
+	}
+
+	if err := update([]byte{0x12, 0x34}, "magic-2", "com.apple.mgmt.External.2"); err != nil {
+		t.Fatal(err)
+	}
+	want := PushInfo{UDID: saved.UDID, Token: "1234", PushMagic: "magic-2", MDMTopic: "com.apple.mgmt.External.2"}
+	if have := db.infos[saved.UDID]; have != want {
+		t.Errorf("have %+v, want %+v", have, want)
+	}
+}
+
+// memWorkerStore is a WorkerStore and Store keyed by UDID.
+type memWorkerStore struct {
+	infos map[string]PushInfo
+}
+
+func (s *memWorkerStore) Save(ctx context.Context, info *PushInfo) error {
+	s.infos[info.UDID] = *info
+	return nil
+}
+
+func (s *memWorkerStore) Delete(ctx context.Context, udid string) error {
+	delete(s.infos, udid)
+	return nil
+}
+
+func (s *memWorkerStore) PushInfo(ctx context.Context, udid string) (*PushInfo, error) {
+	info, ok := s.infos[udid]
+	if !ok {
+		return nil, errors.Errorf("push info for udid %s not found", udid)
+	}
+	return &info, nil
+}
@@ -1,6 +1,9 @@
 package device
 
 import (
+	"encoding/json"
+	"fmt"
+	"reflect"
 	"time"
 
 	"github.com/gogo/protobuf/proto"
@@ -11,33 +14,92 @@ import (
 
 const DeviceEnrolledTopic = "mdm.DeviceEnrolled"
 
+// Device is a device known to MicroMDM, from DEP or from enrolling.
+// The MDM topic a device is pushed on is not stored with it, but with its apns push info.
 type Device struct {
-	UUID                   string           `db:"uuid"`
-	UDID                   string           `db:"udid"`
-	SerialNumber           string           `db:"serial_number"`
-	OSVersion              string           `db:"os_version"`
-	BuildVersion           string           `db:"build_version"`
-	ProductName            string           `db:"product_name"`
-	IMEI                   string           `db:"imei"`
-	MEID                   string           `db:"meid"`
-	PushMagic              string           `db:"push_magic"`
-	AwaitingConfiguration  bool             `db:"awaiting_configuration"`
-	Token                  string           `db:"token"`
-	UnlockToken            string           `db:"unlock_token"`
-	Enrolled               bool             `db:"enrolled"`
-	Description            string           `db:"description"`
-	Model                  string           `db:"model"`
-	ModelName              string           `db:"model_name"`
-	DeviceName             string           `db:"device_name"`
-	Color                  string           `db:"color"`
-	AssetTag               string           `db:"asset_tag"`
-	DEPProfileStatus       DEPProfileStatus `db:"dep_profile_status"`
-	DEPProfileUUID         string           `db:"dep_profile_uuid"`
-	DEPProfileAssignTime   time.Time        `db:"dep_profile_assign_time"`
-	DEPProfilePushTime     time.Time        `db:"dep_profile_push_time"`
-	DEPProfileAssignedDate time.Time        `db:"dep_profile_assigned_date"`
-	DEPProfileAssignedBy   string           `db:"dep_profile_assigned_by"`
-	LastSeen               time.Time        `db:"last_seen"`
+	UUID                   string           `db:"uuid" json:"uuid"`
+	UDID                   string           `db:"udid" json:"udid"`
+	SerialNumber           string           `db:"serial_number" json:"serial_number"`
+	OSVersion              string           `db:"os_version" json:"os_version"`
+	BuildVersion           string           `db:"build_version" json:"build_version"`
+	ProductName            string           `db:"product_name" json:"product_name"`
+	IMEI                   string           `db:"imei" json:"imei"`
+	MEID                   string           `db:"meid" json:"meid"`
+	PushMagic              string           `db:"push_magic" json:"push_magic,omitempty"`
+	AwaitingConfiguration  bool             `db:"awaiting_configuration" json:"awaiting_configuration"`
+	Token                  string           `db:"token" json:"token,omitempty"`
+	UnlockToken            string           `db:"unlock_token" json:"unlock_token,omitempty"`
+	Enrolled               bool             `db:"enrolled" json:"enrolled"`
+	Description            string           `db:"description" json:"description"`
+	Model                  string           `db:"model" json:"model"`
+	ModelName              string           `db:"model_name" json:"model_name"`
+	DeviceName             string           `db:"device_name" json:"device_name"`
+	Color                  string           `db:"color" json:"color"`
+	AssetTag               string           `db:"asset_tag" json:"asset_tag"`
+	DEPProfileStatus       DEPProfileStatus `db:"dep_profile_status" json:"dep_profile_status"`
+	DEPProfileUUID         string           `db:"dep_profile_uuid" json:"dep_profile_uuid"`
+	DEPProfileAssignTime   *time.Time       `db:"dep_profile_assign_time" json:"dep_profile_assign_time"`
+	DEPProfilePushTime     *time.Time       `db:"dep_profile_push_time" json:"dep_profile_push_time"`
+	DEPProfileAssignedDate *time.Time       `db:"dep_profile_assigned_date" json:"dep_profile_assigned_date"`
+	DEPProfileAssignedBy   string           `db:"dep_profile_assigned_by" json:"dep_profile_assigned_by"`
+	LastSeen               time.Time        `db:"last_seen" json:"last_seen"`
+	TotalStorage           int64            `db:"total_storage" json:"total_storage"`
+	AvailableStorage       int64            `db:"available_storage" json:"available_storage"`
+	CreatedAt              time.Time        `db:"created_at" json:"created_at"`
+	UpdatedAt              time.Time        `db:"updated_at" json:"updated_at"`
+}
+
+// deviceJSON has the fields and JSON tags of Device, without its MarshalJSON method.
+type deviceJSON Device
+
+// MarshalJSON encodes the device with snake_case field names.
+// The push and unlock tokens of the device are omitted, see WithSecrets to include them.
+func (dev Device) MarshalJSON() ([]byte, error) {
+	redacted := deviceJSON(dev)
+	redacted.Token = ""
+	redacted.PushMagic = ""
+	redacted.UnlockToken = ""
+	return json.Marshal(redacted)
+}
+
+// WithSecrets returns the device for encoding as JSON with its push and unlock tokens included,
+// for example to export it.
+func (dev Device) WithSecrets() json.Marshaler {
+	return deviceWithSecrets(dev)
+}
+
+type deviceWithSecrets Device
+
+func (dev deviceWithSecrets) MarshalJSON() ([]byte, error) {
+	return json.Marshal(deviceJSON(dev))
+}
+
+// String formats the device like %+v, with its secrets redacted by RedactDevice,
+// so that logging a device never exposes them. Missing DEP profile times are formatted as <nil>.
+func (dev Device) String() string {
+	return fmt.Sprintf("%+v", deviceJSON(RedactDevice(dev)))
+}
+
+// RedactDevice returns a copy of dev with its push token, push magic and unlock token
+// masked by RedactSecret.
+func RedactDevice(dev Device) Device {
+	dev.Token = RedactSecret(dev.Token)
+	dev.PushMagic = RedactSecret(dev.PushMagic)
+	dev.UnlockToken = RedactSecret(dev.UnlockToken)
+	return dev
+}
+
+// RedactSecret masks all but the last 4 characters of secret, enough to tell secrets apart in logs.
+// Secrets too short to keep 4 characters of are masked completely, and an empty secret stays empty.
+func RedactSecret(secret string) string {
+	switch {
+	case secret == "":
+		return ""
+	case len(secret) <= 8:
+		return "****"
+	default:
+		return "****" + secret[len(secret)-4:]
+	}
 }
 
 // DEPProfileStatus is the status of the DEP Profile
@@ -52,6 +114,51 @@ const (
 	REMOVED                   = "removed"
 )
 
+// Validate checks that dev has the fields required to save it.
+// Every device needs a UUID, and a serial number (DEP devices) or a UDID (enrolled devices) to find it by.
+func (dev *Device) Validate() error {
+	if dev.UUID == "" {
+		return errors.New("device is missing a uuid")
+	}
+	if dev.SerialNumber == "" && dev.UDID == "" {
+		return errors.Errorf("device %s has neither a serial number nor a udid", dev.UUID)
+	}
+	return nil
+}
+
+// DiffFields returns the column names, as in the db tags of Device, of the fields whose values differ
+// between dev and updated. CreatedAt and UpdatedAt are maintained by the store and never reported.
+// Apart from the DEP profile times, device fields cannot be NULL, so a column read as NULL and
+// one read as empty compare equal.
+func (dev *Device) DiffFields(updated *Device) []string {
+	var changed []string
+	ov, nv := reflect.ValueOf(dev).Elem(), reflect.ValueOf(updated).Elem()
+	for i := 0; i < ov.NumField(); i++ {
+		col := ov.Type().Field(i).Tag.Get("db")
+		if col == "created_at" || col == "updated_at" {
+			continue
+		}
+		of, nf := ov.Field(i).Interface(), nv.Field(i).Interface()
+		if ot, ok := of.(time.Time); ok {
+			if !ot.Equal(nf.(time.Time)) {
+				changed = append(changed, col)
+			}
+			continue
+		}
+		if ot, ok := of.(*time.Time); ok {
+			nt := nf.(*time.Time)
+			if (ot == nil) != (nt == nil) || (ot != nil && !ot.Equal(*nt)) {
+				changed = append(changed, col)
+			}
+			continue
+		}
+		if of != nf {
+			changed = append(changed, col)
+		}
+	}
+	return changed
+}
+
 func MarshalDevice(dev *Device) ([]byte, error) {
 	protodev := deviceproto.Device{
 		Uuid:                   dev.UUID,
@@ -75,9 +182,9 @@ func MarshalDevice(dev *Device) ([]byte, error) {
 		AssetTag:               dev.AssetTag,
 		DepProfileStatus:       string(dev.DEPProfileStatus),
 		DepProfileUuid:         dev.DEPProfileUUID,
-		DepProfileAssignTime:   timeToNano(dev.DEPProfileAssignTime),
-		DepProfilePushTime:     timeToNano(dev.DEPProfilePushTime),
-		DepProfileAssignedDate: timeToNano(dev.DEPProfileAssignedDate),
+		DepProfileAssignTime:   optionalTimeToNano(dev.DEPProfileAssignTime),
+		DepProfilePushTime:     optionalTimeToNano(dev.DEPProfilePushTime),
+		DepProfileAssignedDate: optionalTimeToNano(dev.DEPProfileAssignedDate),
 		DepProfileAssignedBy:   dev.DEPProfileAssignedBy,
 		LastSeen:               timeToNano(dev.LastSeen),
 	}
@@ -110,9 +217,9 @@ func UnmarshalDevice(data []byte, dev *Device) error {
 	dev.AssetTag = pb.GetAssetTag()
 	dev.DEPProfileStatus = DEPProfileStatus(pb.GetDepProfileStatus())
 	dev.DEPProfileUUID = pb.GetDepProfileUuid()
-	dev.DEPProfileAssignTime = timeFromNano(pb.GetDepProfileAssignTime())
-	dev.DEPProfilePushTime = timeFromNano(pb.GetDepProfilePushTime())
-	dev.DEPProfileAssignedDate = timeFromNano(pb.GetDepProfileAssignedDate())
+	dev.DEPProfileAssignTime = optionalTime(timeFromNano(pb.GetDepProfileAssignTime()))
+	dev.DEPProfilePushTime = optionalTime(timeFromNano(pb.GetDepProfilePushTime()))
+	dev.DEPProfileAssignedDate = optionalTime(timeFromNano(pb.GetDepProfileAssignedDate()))
 	dev.DEPProfileAssignedBy = pb.GetDepProfileAssignedBy()
 	dev.LastSeen = timeFromNano(pb.GetLastSeen())
 	return nil
@@ -131,3 +238,19 @@ func timeFromNano(nano int64) time.Time {
 	}
 	return time.Unix(0, nano).UTC()
 }
+
+func optionalTimeToNano(t *time.Time) int64 {
+	if t == nil {
+		return 0
+	}
+	return timeToNano(*t)
+}
+
+// optionalTime returns a pointer to t, or nil if t is the zero time,
+// for the DEP profile times which DEP leaves out when they are unknown.
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
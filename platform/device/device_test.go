@@ -0,0 +1,167 @@
+package device
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		dev     Device
+		wantErr bool
+	}{
+		{"dep device", Device{UUID: "a", SerialNumber: "C02FOO"}, false},
+		{"enrolled device", Device{UUID: "a", UDID: "UDID-FOO", SerialNumber: "C02FOO"}, false},
+		{"manual enrollment", Device{UUID: "a", UDID: "UDID-FOO"}, false},
+		{"missing uuid", Device{SerialNumber: "C02FOO"}, true},
+		{"missing identifiers", Device{UUID: "a"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.dev.Validate()
+			if have, want := err != nil, tt.wantErr; have != want {
+				t.Errorf("have err %v, want error: %v", err, want)
+			}
+		})
+	}
+}
+
+func TestDeviceJSON(t *testing.T) {
+	seen := time.Date(2020, 3, 1, 12, 30, 0, 0, time.UTC)
+	dev := Device{
+		UUID:                 "5b7a9c0e-6f1d-4a8b-9c1e-2d3f4a5b6c7d",
+		UDID:                 "UDID-FOO",
+		SerialNumber:         "C02FOO",
+		OSVersion:            "13.3.1",
+		BuildVersion:         "17D50",
+		ProductName:          "iPad8,1",
+		IMEI:                 "35 123456 789012 3",
+		PushMagic:            "push-magic",
+		Token:                "push-token",
+		UnlockToken:          "unlock-token",
+		Enrolled:             true,
+		Description:          "IPAD PRO 11",
+		Model:                "iPad Pro",
+		ModelName:            "iPad",
+		DeviceName:           "Front Desk",
+		Color:                "Space Gray",
+		AssetTag:             "IT-0001",
+		DEPProfileStatus:     ASSIGNED,
+		DEPProfileUUID:       "profile-1",
+		DEPProfileAssignTime: &seen,
+		DEPProfileAssignedBy: "admin@example.com",
+		LastSeen:             seen,
+		TotalStorage:         64000000000,
+		AvailableStorage:     12500000000,
+	}
+
+	data, err := json.MarshalIndent(dev, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	golden, err := ioutil.ReadFile(filepath.Join("testdata", "device.golden.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := string(data), strings.TrimSpace(string(golden)); have != want {
+		t.Errorf("device JSON does not match testdata/device.golden.json:\n%s", have)
+	}
+
+	// WithSecrets includes the tokens, and decodes back into the same device.
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(dev.WithSecrets()); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{`"token":"push-token"`, `"push_magic":"push-magic"`, `"unlock_token":"unlock-token"`} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("WithSecrets JSON %s missing %s", buf.String(), want)
+		}
+	}
+	var decoded Device
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, dev) {
+		t.Errorf("have %+v, want %+v", decoded, dev)
+	}
+}
+
+func TestRedactDevice(t *testing.T) {
+	dev := Device{
+		UUID:        "a",
+		Token:       "d3ad6e3f9c2b4a1e8f7d6c5b4a3e2f1d",
+		PushMagic:   "2F6E8A1C-9B3D-4E5F-A6B7-C8D9E0F1A2B3",
+		UnlockToken: "short",
+	}
+
+	redacted := RedactDevice(dev)
+	if have, want := redacted.Token, "****2f1d"; have != want {
+		t.Errorf("token: have %s, want %s", have, want)
+	}
+	if have, want := redacted.PushMagic, "****A2B3"; have != want {
+		t.Errorf("push magic: have %s, want %s", have, want)
+	}
+	if have, want := redacted.UnlockToken, "****"; have != want {
+		t.Errorf("unlock token: have %s, want %s", have, want)
+	}
+	if dev.Token == redacted.Token {
+		t.Error("RedactDevice modified its argument")
+	}
+
+	var buf bytes.Buffer
+	logger := log.NewLogfmtLogger(&buf)
+	_ = logger.Log("device", dev)
+	_ = logger.Log("device", &dev)
+	fmt.Fprintf(&buf, "%v %+v", dev, dev)
+	for _, secret := range []string{dev.Token, dev.PushMagic, dev.UnlockToken} {
+		if strings.Contains(buf.String(), secret) {
+			t.Errorf("logged device contains secret %q: %s", secret, buf.String())
+		}
+	}
+}
+
+func TestDeviceString(t *testing.T) {
+	assigned := time.Date(2020, 3, 1, 12, 30, 0, 0, time.UTC)
+	dev := Device{UUID: "a", DEPProfileAssignTime: &assigned}
+
+	s := dev.String()
+	for _, want := range []string{
+		"DEPProfileAssignTime:2020-03-01 12:30:00 +0000 UTC",
+		"DEPProfilePushTime:<nil>",
+		"DEPProfileAssignedDate:<nil>",
+	} {
+		if !strings.Contains(s, want) {
+			t.Errorf("String %s missing %s", s, want)
+		}
+	}
+	if strings.Contains(s, "0x") {
+		t.Errorf("String %s contains a pointer address", s)
+	}
+}
+
+func TestDiffFields(t *testing.T) {
+	seen := time.Date(2020, 3, 1, 12, 30, 0, 0, time.UTC)
+	old := Device{UUID: "a", UDID: "UDID-FOO", OSVersion: "13.3", Enrolled: true, LastSeen: seen, CreatedAt: seen}
+	new := old
+	new.OSVersion = "13.3.1"
+	new.Enrolled = false
+	new.LastSeen = seen.In(time.FixedZone("PST", -8*60*60)) // the same instant
+	new.UpdatedAt = time.Now()
+
+	if have, want := strings.Join(old.DiffFields(&new), ","), "os_version,enrolled"; have != want {
+		t.Errorf("have %s, want %s", have, want)
+	}
+	if have := old.DiffFields(&old); len(have) != 0 {
+		t.Errorf("device differs from itself in %v", have)
+	}
+}
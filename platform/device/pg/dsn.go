@@ -0,0 +1,130 @@
+package pg
+
+import (
+	"context"
+	"database/sql"
+	"net"
+	"net/url"
+	"strconv"
+
+	"github.com/go-kit/kit/log"
+	"github.com/jmoiron/sqlx"
+	"github.com/kolide/kit/dbutil"
+	"github.com/pkg/errors"
+)
+
+// DSN holds the settings of a Postgres connection. Empty fields are left out of the
+// connection string, so the lib/pq defaults apply to them.
+type DSN struct {
+	Host     string
+	Port     int
+	User     string
+	Password string
+	DBName   string
+	SSLMode  string
+
+	// SSLRootCert is the path of the CA certificates the server certificate is verified against.
+	SSLRootCert string
+}
+
+// String returns the connection string of dsn as a postgres:// URL, with the
+// user and password escaped. It includes the password, see Redacted for logging.
+func (dsn DSN) String() string {
+	u := url.URL{Scheme: "postgres", Host: dsn.Host, Path: "/" + dsn.DBName}
+	if dsn.Port != 0 {
+		u.Host = net.JoinHostPort(dsn.Host, strconv.Itoa(dsn.Port))
+	}
+	switch {
+	case dsn.Password != "":
+		u.User = url.UserPassword(dsn.User, dsn.Password)
+	case dsn.User != "":
+		u.User = url.User(dsn.User)
+	}
+	params := url.Values{}
+	if dsn.SSLMode != "" {
+		params.Set("sslmode", dsn.SSLMode)
+	}
+	if dsn.SSLRootCert != "" {
+		params.Set("sslrootcert", dsn.SSLRootCert)
+	}
+	u.RawQuery = params.Encode()
+	return u.String()
+}
+
+// WithTLS returns dsn requiring a TLS connection, with the server certificate verified against
+// the CA certificates in caPath. With verifyFull the server host name is checked as well
+// (sslmode=verify-full), otherwise only the certificate chain is (sslmode=verify-ca).
+// Neither mode falls back to a plaintext connection.
+func (dsn DSN) WithTLS(caPath string, verifyFull bool) (DSN, error) {
+	if caPath == "" {
+		return dsn, errors.New("verifying the database server certificate requires a CA certificate path")
+	}
+	dsn.SSLMode, dsn.SSLRootCert = "verify-ca", caPath
+	if verifyFull {
+		dsn.SSLMode = "verify-full"
+	}
+	return dsn, nil
+}
+
+// Validate rejects a CA certificate with an sslmode which does not verify the server certificate,
+// because lib/pq would silently ignore the certificate, or connect in plaintext.
+func (dsn DSN) Validate() error {
+	if dsn.SSLRootCert == "" {
+		return nil
+	}
+	switch dsn.SSLMode {
+	case "verify-ca", "verify-full":
+		return nil
+	default:
+		return errors.Errorf("sslmode %q does not verify the server certificate against sslrootcert", dsn.SSLMode)
+	}
+}
+
+// Redacted returns the connection string of dsn with the password masked.
+func (dsn DSN) Redacted() string {
+	if dsn.Password != "" {
+		dsn.Password = "xxxxx"
+	}
+	return dsn.String()
+}
+
+// NewFromDSN connects to the database described by dsn with Open and returns a store using it.
+// Failed connection attempts are logged to logger, and errors never include the password of dsn.
+// The schema of the devices table is checked like NewChecked before the store is returned.
+// See Open to configure the connection attempts, and WithPool to size the connection pool.
+func NewFromDSN(driver string, dsn DSN, logger log.Logger, opts ...Option) (*Postgres, error) {
+	db, err := Open(driver, dsn, dbutil.WithLogger(logger))
+	if err != nil {
+		return nil, err
+	}
+	d, err := NewChecked(context.Background(), db, opts...)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return d, nil
+}
+
+// Open validates dsn and connects to the database it describes, retrying failed attempts like
+// dbutil.OpenDBX, which opts are passed to, for example dbutil.WithMaxAttempts.
+// Errors never include the password of dsn. The returned handle can be passed to New.
+func Open(driver string, dsn DSN, opts ...dbutil.Option) (*sqlx.DB, error) {
+	// dbutil includes the whole connection string in the error for an unknown driver.
+	if !registered(driver) {
+		return nil, errors.Errorf("unknown sql driver %q", driver)
+	}
+	if err := dsn.Validate(); err != nil {
+		return nil, err
+	}
+	db, err := dbutil.OpenDBX(driver, dsn.String(), opts...)
+	return db, errors.Wrapf(err, "connecting to %s", dsn.Redacted())
+}
+
+func registered(driver string) bool {
+	for _, name := range sql.Drivers() {
+		if name == driver {
+			return true
+		}
+	}
+	return false
+}
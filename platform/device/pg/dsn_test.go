@@ -0,0 +1,112 @@
+package pg
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/kolide/kit/dbutil"
+	"github.com/lib/pq"
+)
+
+func TestDSN(t *testing.T) {
+	dsn := DSN{
+		Host:     "db.example.com",
+		Port:     5433,
+		User:     "micromdm",
+		Password: "p@ss w:rd/?#%",
+		DBName:   "micromdm",
+		SSLMode:  "verify-full",
+	}
+
+	// lib/pq must parse the password back out of the URL unchanged.
+	conn, err := pq.ParseURL(dsn.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"host=db.example.com",
+		"port=5433",
+		"user=micromdm",
+		`password=p@ss\ w:rd/?#%`,
+		"dbname=micromdm",
+		"sslmode=verify-full",
+	} {
+		if !strings.Contains(conn, want) {
+			t.Errorf("connection string %q missing %q", conn, want)
+		}
+	}
+
+	if redacted := dsn.Redacted(); strings.Contains(redacted, "rd") {
+		t.Errorf("redacted connection string %q contains the password", redacted)
+	}
+
+	if have, want := (DSN{Host: "localhost", DBName: "micromdm"}).String(), "postgres://localhost/micromdm"; have != want {
+		t.Errorf("have %s, want %s", have, want)
+	}
+}
+
+func TestDSNWithTLS(t *testing.T) {
+	dsn := DSN{Host: "db.example.com", User: "micromdm", DBName: "micromdm", SSLMode: "disable"}
+
+	tests := []struct {
+		verifyFull bool
+		want       string
+	}{
+		{verifyFull: true, want: "sslmode=verify-full"},
+		{verifyFull: false, want: "sslmode=verify-ca"},
+	}
+	for _, tt := range tests {
+		secure, err := dsn.WithTLS("/etc/micromdm/db-ca.pem", tt.verifyFull)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := secure.Validate(); err != nil {
+			t.Error(err)
+		}
+		conn := secure.String()
+		for _, want := range []string{tt.want, "sslrootcert=%2Fetc%2Fmicromdm%2Fdb-ca.pem"} {
+			if !strings.Contains(conn, want) {
+				t.Errorf("connection string %q missing %q", conn, want)
+			}
+		}
+	}
+
+	if _, err := dsn.WithTLS("", true); err == nil {
+		t.Error("expected an error verifying without a CA certificate")
+	}
+
+	for _, mode := range []string{"", "disable", "allow", "prefer", "require"} {
+		insecure := dsn
+		insecure.SSLMode, insecure.SSLRootCert = mode, "/etc/micromdm/db-ca.pem"
+		if err := insecure.Validate(); err == nil {
+			t.Errorf("sslmode %q with a CA certificate was accepted", mode)
+		}
+		if _, err := NewFromDSN("postgres", insecure, log.NewNopLogger()); err == nil {
+			t.Errorf("NewFromDSN connected with sslmode %q", mode)
+		}
+	}
+}
+
+func TestOpenInvalidDSN(t *testing.T) {
+	_, err := Open("postgres", DSN{Host: "localhost", Password: "secret", SSLMode: "require", SSLRootCert: "ca.pem"}, dbutil.WithMaxAttempts(1))
+	if err == nil || strings.Contains(err.Error(), "secret") {
+		t.Errorf("have %v, want an error without the password", err)
+	}
+}
+
+func TestWithPool(t *testing.T) {
+	db := New(lazySetup(t).db, WithPool(7, 3, time.Minute))
+	defer db.Close()
+	if have, want := db.db.Stats().MaxOpenConnections, 7; have != want {
+		t.Errorf("have max open connections %d, want %d", have, want)
+	}
+}
+
+func TestNewFromDSNUnknownDriver(t *testing.T) {
+	_, err := NewFromDSN("postgress", DSN{Host: "localhost", Password: "secret"}, log.NewNopLogger())
+	if err == nil || strings.Contains(err.Error(), "secret") {
+		t.Errorf("have %v, want an error without the password", err)
+	}
+}
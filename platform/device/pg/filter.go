@@ -0,0 +1,286 @@
+package pg
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/lib/pq"
+	sq "gopkg.in/Masterminds/squirrel.v1"
+
+	"github.com/micromdm/micromdm/platform/device"
+)
+
+var notDeleted = sq.Eq{"deleted_at": nil}
+
+// Not filters devices which do not match Filter. It composes with sq.Or and sq.And:
+//
+//	Not{sq.Or{DEPProfileStatus{device.ASSIGNED}, DEPProfileStatus{device.PUSHED}}}
+//
+// Like any SQL negation, rows for which Filter is NULL match neither Filter nor Not.
+type Not struct {
+	Filter sq.Sqlizer
+}
+
+func (f Not) ToSql() (string, []interface{}, error) {
+	query, args, err := f.Filter.ToSql()
+	if err != nil {
+		return "", nil, err
+	}
+	return "NOT (" + query + ")", args, nil
+}
+
+// UUID filters devices by their uuid.
+type UUID struct {
+	UUID string
+}
+
+func (f UUID) ToSql() (string, []interface{}, error) {
+	return "uuid = ?", []interface{}{f.UUID}, nil
+}
+
+// UUIDs filters devices whose uuid is one of UUIDs.
+// The uuids are bound as a single array argument, and an empty list matches no devices.
+type UUIDs struct {
+	UUIDs []string
+}
+
+func (f UUIDs) ToSql() (string, []interface{}, error) {
+	return "uuid = ANY(?)", []interface{}{pq.Array(f.UUIDs)}, nil
+}
+
+// SerialNumber filters devices by their serial number.
+type SerialNumber struct {
+	SerialNumber string
+}
+
+func (f SerialNumber) ToSql() (string, []interface{}, error) {
+	return "serial_number = ?", []interface{}{normalizeSerial(f.SerialNumber)}, nil
+}
+
+// LastSeenBefore filters devices which have not checked in since Time.
+type LastSeenBefore struct {
+	Time time.Time
+}
+
+func (f LastSeenBefore) ToSql() (string, []interface{}, error) {
+	return "last_seen < ?", []interface{}{f.Time}, nil
+}
+
+// DEPProfileStatus filters devices by the status of their DEP profile.
+type DEPProfileStatus struct {
+	Status device.DEPProfileStatus
+}
+
+func (f DEPProfileStatus) ToSql() (string, []interface{}, error) {
+	return "dep_profile_status = ?", []interface{}{f.Status}, nil
+}
+
+// WorkflowUUID filters devices by the workflow assigned to them.
+type WorkflowUUID struct {
+	UUID string
+}
+
+func (f WorkflowUUID) ToSql() (string, []interface{}, error) {
+	return "workflow_uuid = ?", []interface{}{f.UUID}, nil
+}
+
+// NoWorkflow filters devices which are not assigned a workflow.
+// An empty or NULL workflow_uuid both mean unassigned.
+type NoWorkflow struct{}
+
+func (f NoWorkflow) ToSql() (string, []interface{}, error) {
+	return "COALESCE(workflow_uuid, '') = ''", nil, nil
+}
+
+// Enrolled filters devices by their MDM enrollment status.
+type Enrolled struct {
+	Enrolled bool
+}
+
+func (f Enrolled) ToSql() (string, []interface{}, error) {
+	return "enrolled = ?", []interface{}{f.Enrolled}, nil
+}
+
+// Color filters devices by their color, as reported by DEP.
+type Color struct {
+	Color string
+}
+
+func (f Color) ToSql() (string, []interface{}, error) {
+	return "color = ?", []interface{}{f.Color}, nil
+}
+
+// ModelLike filters devices whose model matches Pattern, ignoring case.
+// Pattern uses the SQL LIKE wildcards % and _.
+type ModelLike struct {
+	Pattern string
+}
+
+func (f ModelLike) ToSql() (string, []interface{}, error) {
+	return "model ILIKE ?", []interface{}{f.Pattern}, nil
+}
+
+// BuildVersion filters devices by their OS build, like "17D50".
+type BuildVersion struct {
+	Build string
+}
+
+func (f BuildVersion) ToSql() (string, []interface{}, error) {
+	return "build_version = ?", []interface{}{f.Build}, nil
+}
+
+// BuildVersionLike filters devices whose OS build starts with Pattern, so that "17D" matches
+// every build of a release. Pattern is a literal prefix: % and _ are not wildcards.
+type BuildVersionLike struct {
+	Pattern string
+}
+
+func (f BuildVersionLike) ToSql() (string, []interface{}, error) {
+	return "build_version LIKE ?", []interface{}{escapeLike(f.Pattern) + "%"}, nil
+}
+
+// DEPAssignFailed filters devices whose last DEP profile assignment failed
+// and should be retried. See RecordDEPAssignResult.
+type DEPAssignFailed struct{}
+
+func (f DEPAssignFailed) ToSql() (string, []interface{}, error) {
+	return "dep_assign_error <> ''", nil, nil
+}
+
+// EnrolledBetween filters devices which first enrolled between Start and End, inclusive.
+type EnrolledBetween struct {
+	Start, End time.Time
+}
+
+func (f EnrolledBetween) ToSql() (string, []interface{}, error) {
+	return "enrolled_at BETWEEN ? AND ?", []interface{}{f.Start, f.End}, nil
+}
+
+// AwaitingConfiguration filters devices by whether they are waiting at the
+// Setup Assistant configuration screen of a DEP enrollment.
+type AwaitingConfiguration struct {
+	Awaiting bool
+}
+
+func (f AwaitingConfiguration) ToSql() (string, []interface{}, error) {
+	return "awaiting_configuration = ?", []interface{}{f.Awaiting}, nil
+}
+
+// ModifiedSince filters devices which were created or changed at or after Time.
+// Recording or claiming a push, see RecordPush and ClaimDevicesForPush, is not a change.
+type ModifiedSince struct {
+	Time time.Time
+}
+
+func (f ModifiedSince) ToSql() (string, []interface{}, error) {
+	return "updated_at >= ?", []interface{}{f.Time}, nil
+}
+
+// MissingPushCredentials filters enrolled devices without a push token or push magic,
+// which cannot be sent a push notification until they enroll again. It is the complement
+// of PushableDevices among enrolled devices.
+type MissingPushCredentials struct{}
+
+func (f MissingPushCredentials) ToSql() (string, []interface{}, error) {
+	return "enrolled = true AND (COALESCE(token, '') = '' OR COALESCE(push_magic, '') = '')", nil, nil
+}
+
+// PushedBefore filters devices which have not been sent a push since Time, including
+// devices which were never pushed. See RecordPush.
+type PushedBefore struct {
+	Time time.Time
+}
+
+func (f PushedBefore) ToSql() (string, []interface{}, error) {
+	return "(last_push_at IS NULL OR last_push_at < ?)", []interface{}{f.Time}, nil
+}
+
+// AttributeEquals filters devices whose custom attribute Key has the text Value. A JSON string
+// attribute compares without its quotes, and other JSON values compare as their JSON text,
+// so the number 12 matches the Value "12". See SetAttribute.
+type AttributeEquals struct {
+	Key, Value string
+}
+
+func (f AttributeEquals) ToSql() (string, []interface{}, error) {
+	return "custom_attributes ->> ?::text = ?", []interface{}{f.Key, f.Value}, nil
+}
+
+// HasTag filters devices labeled with Tag. See AddTags.
+// The tags are read from the tag table of the store, so HasTag can only be passed to the
+// methods taking device query parameters, like Devices, optionally within sq.And, sq.Or and Not.
+type HasTag struct {
+	Tag string
+
+	table string // set by the store, see withTagTable.
+}
+
+func (f HasTag) ToSql() (string, []interface{}, error) {
+	if f.table == "" {
+		return "", nil, errors.New("HasTag filter used outside of a device query")
+	}
+	return "uuid IN (SELECT device_uuid FROM " + f.table + " WHERE tag = ?)", []interface{}{f.Tag}, nil
+}
+
+// withTagTable returns filter with the table of its HasTag filters set to tagTable.
+func withTagTable(filter sq.Sqlizer, tagTable string) sq.Sqlizer {
+	switch f := filter.(type) {
+	case HasTag:
+		f.table = tagTable
+		return f
+	case Not:
+		return Not{Filter: withTagTable(f.Filter, tagTable)}
+	case sq.And:
+		and := make(sq.And, len(f))
+		for i, filter := range f {
+			and[i] = withTagTable(filter, tagTable)
+		}
+		return and
+	case sq.Or:
+		or := make(sq.Or, len(f))
+		for i, filter := range f {
+			or[i] = withTagTable(filter, tagTable)
+		}
+		return or
+	default:
+		return filter
+	}
+}
+
+// OSVersionLessThan filters devices whose os_version is numerically lower than Version,
+// so that "9.3.5" is lower than "16.1". Trailing zeros are insignificant, and devices with
+// an os_version that does not start with a number never match.
+type OSVersionLessThan struct {
+	Version string
+}
+
+func (f OSVersionLessThan) ToSql() (string, []interface{}, error) {
+	version, err := parseOSVersion(f.Version)
+	if err != nil {
+		return "", nil, err
+	}
+	// ?? escapes the placeholder character in the non-capturing group.
+	return `string_to_array(substring(os_version from '^[0-9]+(??:\.[0-9]+)*'), '.')::int[] < ?::int[]`,
+		[]interface{}{pq.Array(version)}, nil
+}
+
+// parseOSVersion splits a dotted version like "16.1" into its numeric components,
+// dropping trailing zeros so that "16" and "16.0" compare equal as arrays.
+func parseOSVersion(version string) ([]int64, error) {
+	parts := strings.Split(version, ".")
+	components := make([]int64, 0, len(parts))
+	for _, part := range parts {
+		n, err := strconv.ParseInt(part, 10, 32)
+		if err != nil || n < 0 {
+			return nil, errors.Errorf("invalid os version %q", version)
+		}
+		components = append(components, n)
+	}
+	for len(components) > 0 && components[len(components)-1] == 0 {
+		components = components[:len(components)-1]
+	}
+	return components, nil
+}
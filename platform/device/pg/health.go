@@ -0,0 +1,99 @@
+package pg
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// WithHealthMonitor pings the database every interval in the background, and logs to logger
+// when it becomes unreachable and when it recovers. Connections broken by a database restart
+// are replaced by the connection pool on the next ping, so queries succeed again once the
+// monitor reports recovery. See Healthy. The monitor is stopped by Close.
+// A non-positive interval is replaced by DefaultHealthCheckInterval.
+func WithHealthMonitor(interval time.Duration, logger log.Logger) Option {
+	return func(d *Postgres) {
+		if interval <= 0 {
+			interval = DefaultHealthCheckInterval
+		}
+		d.monitor = newHealthMonitor(d.Ping, interval, logger)
+	}
+}
+
+// DefaultHealthCheckInterval is the interval of WithHealthMonitor when none is given.
+const DefaultHealthCheckInterval = 30 * time.Second
+
+// Healthy reports whether the last ping of the health monitor succeeded.
+// Without WithHealthMonitor, the store is always reported healthy.
+func (d *Postgres) Healthy() bool {
+	return d.monitor == nil || d.monitor.isHealthy()
+}
+
+type healthMonitor struct {
+	ping     func(context.Context) error
+	interval time.Duration
+	logger   log.Logger
+
+	unhealthy int32 // accessed atomically
+	stopOnce  sync.Once
+	stop      chan struct{}
+	done      chan struct{}
+}
+
+func newHealthMonitor(ping func(context.Context) error, interval time.Duration, logger log.Logger) *healthMonitor {
+	return &healthMonitor{
+		ping:     ping,
+		interval: interval,
+		logger:   logger,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+func (m *healthMonitor) start() {
+	go m.run()
+}
+
+func (m *healthMonitor) run() {
+	defer close(m.done)
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.stop:
+			return
+		case <-ticker.C:
+			m.check()
+		}
+	}
+}
+
+// check pings the database, logging a change of health.
+func (m *healthMonitor) check() {
+	ctx, cancel := context.WithTimeout(context.Background(), m.interval)
+	defer cancel()
+	err := m.ping(ctx)
+	wasHealthy := m.isHealthy()
+	switch {
+	case err != nil && wasHealthy:
+		atomic.StoreInt32(&m.unhealthy, 1)
+		level.Warn(m.logger).Log("msg", "device database unhealthy", "err", err)
+	case err == nil && !wasHealthy:
+		atomic.StoreInt32(&m.unhealthy, 0)
+		level.Info(m.logger).Log("msg", "device database healthy again")
+	}
+}
+
+func (m *healthMonitor) isHealthy() bool {
+	return atomic.LoadInt32(&m.unhealthy) == 0
+}
+
+// close stops the monitor and waits for it to return. It is safe to call more than once.
+func (m *healthMonitor) close() {
+	m.stopOnce.Do(func() { close(m.stop) })
+	<-m.done
+}
@@ -0,0 +1,95 @@
+package pg
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestHealthMonitor(t *testing.T) {
+	var down int32
+	ping := func(ctx context.Context) error {
+		if atomic.LoadInt32(&down) == 1 {
+			return errors.New("connection refused")
+		}
+		return nil
+	}
+	var buf syncBuffer
+	m := newHealthMonitor(ping, time.Millisecond, log.NewLogfmtLogger(&buf))
+	m.start()
+	defer m.close()
+
+	waitFor := func(healthy bool, logged string) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for m.isHealthy() != healthy || !strings.Contains(buf.String(), logged) {
+			if time.Now().After(deadline) {
+				t.Fatalf("monitor did not report healthy=%t, logs:\n%s", healthy, buf.String())
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	atomic.StoreInt32(&down, 1)
+	waitFor(false, `level=warn msg="device database unhealthy" err="connection refused"`)
+
+	atomic.StoreInt32(&down, 0)
+	waitFor(true, `level=info msg="device database healthy again"`)
+
+	// a change of health is logged once, not on every ping.
+	time.Sleep(10 * time.Millisecond)
+	if have, want := strings.Count(buf.String(), "\n"), 2; have != want {
+		t.Errorf("have %d log lines, want %d:\n%s", have, want, buf.String())
+	}
+}
+
+func TestCloseStopsHealthMonitor(t *testing.T) {
+	db := New(lazySetup(t).db, WithHealthMonitor(time.Millisecond, log.NewNopLogger()))
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-db.monitor.done:
+	default:
+		t.Error("health monitor still running after Close")
+	}
+	// closing again must not panic.
+	db.Close()
+}
+
+func TestHealthMonitorDefaultInterval(t *testing.T) {
+	for _, interval := range []time.Duration{0, -time.Second} {
+		db := New(lazySetup(t).db, WithHealthMonitor(interval, log.NewNopLogger()))
+		if have, want := db.monitor.interval, DefaultHealthCheckInterval; have != want {
+			t.Errorf("interval %v: have %v, want %v", interval, have, want)
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// syncBuffer is a bytes.Buffer safe for concurrent use.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
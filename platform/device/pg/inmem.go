@@ -0,0 +1,198 @@
+package pg
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/micromdm/micromdm/platform/device"
+)
+
+// InMemory is a map backed stand-in for Postgres, for testing packages which depend on a device store
+// without a database. It implements the lookup and save methods of Postgres with the same semantics,
+// and device.Store.
+type InMemory struct {
+	mu      sync.RWMutex
+	devices map[string]device.Device // by uuid
+}
+
+var (
+	_ device.Store             = (*InMemory)(nil)
+	_ device.DeviceWorkerStore = (*InMemory)(nil)
+)
+
+func NewInMemory() *InMemory {
+	return &InMemory{devices: make(map[string]device.Device)}
+}
+
+// Save inserts the device, or replaces the device with the same uuid.
+// CreatedAt and UpdatedAt are maintained like the Postgres columns, and like the unique indexes
+// of the devices table, a udid, serial number or asset tag saved for another device is an ErrConflict.
+func (m *InMemory) Save(ctx context.Context, dev *device.Device) error {
+	if err := dev.Validate(); err != nil {
+		return invalid(err)
+	}
+	saved := copyDevice(*dev)
+	saved.SerialNumber = normalizeSerial(saved.SerialNumber)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.conflict(saved); err != nil {
+		return err
+	}
+	saved.CreatedAt, saved.UpdatedAt = time.Now(), time.Now()
+	if existing, ok := m.devices[saved.UUID]; ok {
+		saved.CreatedAt = existing.CreatedAt
+	}
+	m.devices[saved.UUID] = saved
+	return nil
+}
+
+// conflict returns an ErrConflict if another device has the udid, serial number or asset tag of dev.
+// The caller must hold the lock.
+func (m *InMemory) conflict(dev device.Device) error {
+	for uuid, other := range m.devices {
+		if uuid == dev.UUID {
+			continue
+		}
+		var err error
+		switch {
+		case dev.UDID != "" && other.UDID == dev.UDID:
+			err = errors.Errorf("udid %q of device %s is already saved for another device", dev.UDID, dev.UUID)
+		case dev.SerialNumber != "" && other.SerialNumber == dev.SerialNumber:
+			err = errors.Errorf("serial number %q of device %s is already saved for another device", dev.SerialNumber, dev.UUID)
+		case dev.AssetTag != "" && other.AssetTag == dev.AssetTag:
+			err = errors.Errorf("asset tag %q of device %s is already assigned to another device", dev.AssetTag, dev.UUID)
+		}
+		if err != nil {
+			return kindErr{kind: ErrConflict, err: err}
+		}
+	}
+	return nil
+}
+
+func (m *InMemory) DeviceByUDID(ctx context.Context, udid string) (*device.Device, error) {
+	return m.deviceBy(func(dev device.Device) bool { return dev.UDID == udid })
+}
+
+func (m *InMemory) DeviceBySerial(ctx context.Context, serial string) (*device.Device, error) {
+	serial = normalizeSerial(serial)
+	return m.deviceBy(func(dev device.Device) bool { return dev.SerialNumber == serial })
+}
+
+func (m *InMemory) deviceBy(match func(device.Device) bool) (*device.Device, error) {
+	for _, dev := range m.sorted() {
+		if match(dev) {
+			return &dev, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// Devices returns the devices matching all of the provided filters, ordered by uuid.
+// Only the UUID, UUIDs, SerialNumber and Enrolled filters are supported.
+func (m *InMemory) Devices(ctx context.Context, params ...interface{}) ([]device.Device, error) {
+	var matchers []func(device.Device) bool
+	for _, p := range params {
+		switch p := p.(type) {
+		case UUID:
+			matchers = append(matchers, func(dev device.Device) bool { return dev.UUID == p.UUID })
+		case UUIDs:
+			matchers = append(matchers, func(dev device.Device) bool {
+				for _, uuid := range p.UUIDs {
+					if dev.UUID == uuid {
+						return true
+					}
+				}
+				return false
+			})
+		case SerialNumber:
+			serial := normalizeSerial(p.SerialNumber)
+			matchers = append(matchers, func(dev device.Device) bool { return dev.SerialNumber == serial })
+		case Enrolled:
+			matchers = append(matchers, func(dev device.Device) bool { return dev.Enrolled == p.Enrolled })
+		default:
+			return nil, errors.Errorf("unsupported in-memory device query parameter %T", p)
+		}
+	}
+
+	var list []device.Device
+next:
+	for _, dev := range m.sorted() {
+		for _, match := range matchers {
+			if !match(dev) {
+				continue next
+			}
+		}
+		list = append(list, dev)
+	}
+	return list, nil
+}
+
+func (m *InMemory) ListDevices(ctx context.Context, opt device.ListDevicesOption) ([]device.Device, error) {
+	return m.sorted(), nil
+}
+
+// List implements device.Store. Like the builtin store, it only honors opt.FilterSerial.
+func (m *InMemory) List(ctx context.Context, opt device.ListDevicesOption) ([]device.Device, error) {
+	if len(opt.FilterSerial) == 0 {
+		return m.sorted(), nil
+	}
+	var list []device.Device
+	for _, dev := range m.sorted() {
+		for _, serial := range opt.FilterSerial {
+			if normalizeSerial(serial) == dev.SerialNumber {
+				list = append(list, dev)
+				break
+			}
+		}
+	}
+	return list, nil
+}
+
+func (m *InMemory) DeleteByUDID(ctx context.Context, udid string) error {
+	return m.deleteWhere(func(dev device.Device) bool { return dev.UDID == udid })
+}
+
+func (m *InMemory) DeleteBySerial(ctx context.Context, serial string) error {
+	serial = normalizeSerial(serial)
+	return m.deleteWhere(func(dev device.Device) bool { return dev.SerialNumber == serial })
+}
+
+func (m *InMemory) deleteWhere(match func(device.Device) bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for uuid, dev := range m.devices {
+		if match(dev) {
+			delete(m.devices, uuid)
+		}
+	}
+	return nil
+}
+
+// sorted returns a copy of every device, ordered by uuid like the Postgres queries.
+func (m *InMemory) sorted() []device.Device {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	list := make([]device.Device, 0, len(m.devices))
+	for _, dev := range m.devices {
+		list = append(list, copyDevice(dev))
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].UUID < list[j].UUID })
+	return list
+}
+
+// copyDevice returns a copy of dev which shares no DEP profile times with it, so that
+// callers cannot change a saved device through a device they saved or were returned.
+func copyDevice(dev device.Device) device.Device {
+	for _, t := range []**time.Time{&dev.DEPProfileAssignTime, &dev.DEPProfilePushTime, &dev.DEPProfileAssignedDate} {
+		if *t != nil {
+			copied := **t
+			*t = &copied
+		}
+	}
+	return dev
+}
@@ -0,0 +1,167 @@
+package pg
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/micromdm/micromdm/platform/device"
+)
+
+// fakeableStore is the part of Postgres which InMemory implements.
+type fakeableStore interface {
+	device.DeviceWorkerStore
+	Devices(ctx context.Context, params ...interface{}) ([]device.Device, error)
+	DeleteByUDID(ctx context.Context, udid string) error
+	DeleteBySerial(ctx context.Context, serial string) error
+}
+
+var (
+	_ fakeableStore = (*Postgres)(nil)
+	_ fakeableStore = (*InMemory)(nil)
+)
+
+func TestInMemory(t *testing.T) {
+	testFakeableStore(t, NewInMemory())
+}
+
+func TestPostgresMatchesInMemory(t *testing.T) {
+	db := setup(t)
+	resetDevices(t, db)
+	defer resetDevices(t, db)
+	testFakeableStore(t, db)
+}
+
+func TestInMemoryUnsupportedFilter(t *testing.T) {
+	if _, err := NewInMemory().Devices(context.Background(), ModelLike{Pattern: "iPhone%"}); err == nil {
+		t.Error("expected an error for a filter the in-memory store cannot evaluate")
+	}
+}
+
+// testFakeableStore runs the same assertions against both implementations, to keep them in sync.
+func testFakeableStore(t *testing.T, store fakeableStore) {
+	ctx := context.Background()
+
+	if err := store.Save(ctx, &device.Device{UUID: "fake-invalid"}); err == nil {
+		t.Error("expected an error saving a device without a serial number or udid")
+	}
+
+	devs := []*device.Device{
+		{UUID: "fake-1", UDID: "UDID-fake-1", SerialNumber: " c02fake1 ", Enrolled: true},
+		{UUID: "fake-2", SerialNumber: "C02FAKE2"},
+		{UUID: "fake-3", UDID: "UDID-fake-3", SerialNumber: "C02FAKE3", AssetTag: "IT-FAKE3", Enrolled: true},
+	}
+	for _, dev := range devs {
+		if err := store.Save(ctx, dev); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a second device cannot take the udid, serial number or asset tag of a saved one.
+	for _, dev := range []*device.Device{
+		{UUID: "fake-4", UDID: "UDID-fake-1"},
+		{UUID: "fake-4", SerialNumber: "c02fake3 "},
+		{UUID: "fake-4", SerialNumber: "C02FAKE4", AssetTag: "IT-FAKE3"},
+	} {
+		if err := store.Save(ctx, dev); !errors.Is(err, ErrConflict) {
+			t.Errorf("saving %+v: have %v, want ErrConflict", *dev, err)
+		}
+	}
+	// saving a device again does not conflict with itself.
+	if err := store.Save(ctx, devs[2]); err != nil {
+		t.Fatal(err)
+	}
+
+	// saving a device with a known uuid updates it in place.
+	enrolled := *devs[1]
+	enrolled.UDID, enrolled.Enrolled = "UDID-fake-2", true
+	if err := store.Save(ctx, &enrolled); err != nil {
+		t.Fatal(err)
+	}
+
+	found, err := store.DeviceByUDID(ctx, "UDID-fake-2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := found.UUID, "fake-2"; have != want {
+		t.Errorf("by udid: have %s, want %s", have, want)
+	}
+
+	found, err = store.DeviceBySerial(ctx, "c02fake1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := found.SerialNumber, "C02FAKE1"; have != want {
+		t.Errorf("by serial: have %s, want %s", have, want)
+	}
+
+	// the DEP profile times of a saved or returned device are not shared with the store.
+	assigned := time.Date(2020, 3, 1, 12, 30, 0, 0, time.UTC)
+	assignTime := assigned
+	dep := &device.Device{UUID: "fake-5", SerialNumber: "C02FAKE5", DEPProfileAssignTime: &assignTime}
+	if err := store.Save(ctx, dep); err != nil {
+		t.Fatal(err)
+	}
+	*dep.DEPProfileAssignTime = assigned.Add(time.Hour)
+	found, err = store.DeviceBySerial(ctx, "C02FAKE5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	*found.DEPProfileAssignTime = assigned.Add(2 * time.Hour)
+	found, err = store.DeviceBySerial(ctx, "C02FAKE5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found.DEPProfileAssignTime == nil || !found.DEPProfileAssignTime.Equal(assigned) {
+		t.Errorf("saved DEP profile assign time changed: have %v, want %v", found.DEPProfileAssignTime, assigned)
+	}
+	if err := store.DeleteBySerial(ctx, "C02FAKE5"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := store.DeviceByUDID(ctx, "UDID-missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("unknown udid: have %v, want ErrNotFound", err)
+	}
+
+	uuids := func(params ...interface{}) string {
+		t.Helper()
+		list, err := store.Devices(ctx, params...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []string
+		for _, dev := range list {
+			ids = append(ids, dev.UUID)
+		}
+		return strings.Join(ids, ",")
+	}
+	tests := []struct {
+		name   string
+		params []interface{}
+		want   string
+	}{
+		{"all", nil, "fake-1,fake-2,fake-3"},
+		{"uuid", []interface{}{UUID{UUID: "fake-3"}}, "fake-3"},
+		{"uuids", []interface{}{UUIDs{UUIDs: []string{"fake-3", "fake-1"}}}, "fake-1,fake-3"},
+		{"serial", []interface{}{SerialNumber{SerialNumber: "c02fake2"}}, "fake-2"},
+		{"enrolled and uuids", []interface{}{Enrolled{Enrolled: true}, UUIDs{UUIDs: []string{"fake-2", "fake-4"}}}, "fake-2"},
+	}
+	for _, tt := range tests {
+		if have := uuids(tt.params...); have != tt.want {
+			t.Errorf("%s: have %q, want %q", tt.name, have, tt.want)
+		}
+	}
+
+	if err := store.DeleteByUDID(ctx, "UDID-fake-1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.DeleteBySerial(ctx, "c02fake3"); err != nil {
+		t.Fatal(err)
+	}
+	if have, want := uuids(), "fake-2"; have != want {
+		t.Errorf("after delete: have %q, want %q", have, want)
+	}
+}
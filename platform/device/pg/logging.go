@@ -0,0 +1,682 @@
+package pg
+
+import (
+	"context"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+
+	"github.com/micromdm/micromdm/platform/device"
+)
+
+// LoggingMiddleware logs every Store method call with its key parameters, the error and the duration.
+func LoggingMiddleware(logger log.Logger, opts ...LoggingOption) Middleware {
+	var config loggingConfig
+	for _, opt := range opts {
+		opt(&config)
+	}
+	if config.slowOnly {
+		logger = slowCallLogger{next: level.Warn(logger), threshold: config.slowThreshold}
+	}
+	return func(next Store) Store {
+		return loggingMiddleware{
+			next:   next,
+			logger: logger,
+		}
+	}
+}
+
+// LoggingOption configures LoggingMiddleware.
+type LoggingOption func(*loggingConfig)
+
+type loggingConfig struct {
+	slowOnly      bool
+	slowThreshold time.Duration
+}
+
+// WithSlowQueryThreshold only logs the Store method calls which took at least threshold, at warn level.
+// Faster calls are not logged.
+func WithSlowQueryThreshold(threshold time.Duration) LoggingOption {
+	return func(c *loggingConfig) {
+		c.slowOnly = true
+		c.slowThreshold = threshold
+	}
+}
+
+// slowCallLogger drops the log lines whose "took" duration is below threshold.
+type slowCallLogger struct {
+	next      log.Logger
+	threshold time.Duration
+}
+
+func (l slowCallLogger) Log(keyvals ...interface{}) error {
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		if took, ok := keyvals[i+1].(time.Duration); ok && keyvals[i] == "took" && took < l.threshold {
+			return nil
+		}
+	}
+	return l.next.Log(keyvals...)
+}
+
+type loggingMiddleware struct {
+	next   Store
+	logger log.Logger
+}
+
+func (mw loggingMiddleware) Save(ctx context.Context, dev *device.Device) (err error) {
+	defer func(begin time.Time) {
+		_ = mw.logger.Log(
+			"method", "Save",
+			"uuid", dev.UUID,
+			"udid", dev.UDID,
+			"serial", dev.SerialNumber,
+			"err", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.Save(ctx, dev)
+}
+
+func (mw loggingMiddleware) BulkSave(ctx context.Context, devices []*device.Device) (err error) {
+	defer func(begin time.Time) {
+		_ = mw.logger.Log(
+			"method", "BulkSave",
+			"device_count", len(devices),
+			"err", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.BulkSave(ctx, devices)
+}
+
+func (mw loggingMiddleware) UpdateDevice(ctx context.Context, dev *device.Device) (err error) {
+	defer func(begin time.Time) {
+		_ = mw.logger.Log(
+			"method", "UpdateDevice",
+			"uuid", dev.UUID,
+			"err", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.UpdateDevice(ctx, dev)
+}
+
+func (mw loggingMiddleware) AssignWorkflow(ctx context.Context, deviceUUIDs []string, workflowUUID string) (n int, err error) {
+	defer func(begin time.Time) {
+		_ = mw.logger.Log(
+			"method", "AssignWorkflow",
+			"device_count", len(deviceUUIDs),
+			"workflow_uuid", workflowUUID,
+			"updated", n,
+			"err", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.AssignWorkflow(ctx, deviceUUIDs, workflowUUID)
+}
+
+func (mw loggingMiddleware) DeviceByUDID(ctx context.Context, udid string) (dev *device.Device, err error) {
+	defer func(begin time.Time) {
+		_ = mw.logger.Log(
+			"method", "DeviceByUDID",
+			"udid", udid,
+			"err", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.DeviceByUDID(ctx, udid)
+}
+
+func (mw loggingMiddleware) DeviceBySerial(ctx context.Context, serial string) (dev *device.Device, err error) {
+	defer func(begin time.Time) {
+		_ = mw.logger.Log(
+			"method", "DeviceBySerial",
+			"serial", serial,
+			"err", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.DeviceBySerial(ctx, serial)
+}
+
+func (mw loggingMiddleware) DeviceByIMEI(ctx context.Context, imei string) (dev *device.Device, err error) {
+	defer func(begin time.Time) {
+		_ = mw.logger.Log(
+			"method", "DeviceByIMEI",
+			"imei", imei,
+			"err", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.DeviceByIMEI(ctx, imei)
+}
+
+func (mw loggingMiddleware) DeviceByMEID(ctx context.Context, meid string) (dev *device.Device, err error) {
+	defer func(begin time.Time) {
+		_ = mw.logger.Log(
+			"method", "DeviceByMEID",
+			"meid", meid,
+			"err", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.DeviceByMEID(ctx, meid)
+}
+
+func (mw loggingMiddleware) DeviceByPushToken(ctx context.Context, token string) (dev *device.Device, err error) {
+	defer func(begin time.Time) {
+		_ = mw.logger.Log(
+			"method", "DeviceByPushToken",
+			"token", device.RedactSecret(token),
+			"err", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.DeviceByPushToken(ctx, token)
+}
+
+func (mw loggingMiddleware) ListDevices(ctx context.Context, opt device.ListDevicesOption) (devices []device.Device, err error) {
+	defer func(begin time.Time) {
+		_ = mw.logger.Log(
+			"method", "ListDevices",
+			"device_count", len(devices),
+			"err", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.ListDevices(ctx, opt)
+}
+
+func (mw loggingMiddleware) Devices(ctx context.Context, params ...interface{}) (devices []device.Device, err error) {
+	defer func(begin time.Time) {
+		_ = mw.logger.Log(
+			"method", "Devices",
+			"param_count", len(params),
+			"device_count", len(devices),
+			"err", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.Devices(ctx, params...)
+}
+
+func (mw loggingMiddleware) CountDevices(ctx context.Context, params ...interface{}) (n int, err error) {
+	defer func(begin time.Time) {
+		_ = mw.logger.Log(
+			"method", "CountDevices",
+			"param_count", len(params),
+			"count", n,
+			"err", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.CountDevices(ctx, params...)
+}
+
+func (mw loggingMiddleware) PushableDevices(ctx context.Context) (devices []device.Device, err error) {
+	defer func(begin time.Time) {
+		_ = mw.logger.Log(
+			"method", "PushableDevices",
+			"device_count", len(devices),
+			"err", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.PushableDevices(ctx)
+}
+
+func (mw loggingMiddleware) DeleteDevice(ctx context.Context, uuid string) (err error) {
+	defer func(begin time.Time) {
+		_ = mw.logger.Log(
+			"method", "DeleteDevice",
+			"uuid", uuid,
+			"err", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.DeleteDevice(ctx, uuid)
+}
+
+func (mw loggingMiddleware) DeleteByUDID(ctx context.Context, udid string) (err error) {
+	defer func(begin time.Time) {
+		_ = mw.logger.Log(
+			"method", "DeleteByUDID",
+			"udid", udid,
+			"err", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.DeleteByUDID(ctx, udid)
+}
+
+func (mw loggingMiddleware) DeleteBySerial(ctx context.Context, serial string) (err error) {
+	defer func(begin time.Time) {
+		_ = mw.logger.Log(
+			"method", "DeleteBySerial",
+			"serial", serial,
+			"err", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.DeleteBySerial(ctx, serial)
+}
+
+func (mw loggingMiddleware) Search(ctx context.Context, term string, limit int) (devices []device.Device, err error) {
+	defer func(begin time.Time) {
+		_ = mw.logger.Log(
+			"method", "Search",
+			"term", term,
+			"limit", limit,
+			"device_count", len(devices),
+			"err", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.Search(ctx, term, limit)
+}
+
+func (mw loggingMiddleware) RecordDEPAssignResult(ctx context.Context, serial string, assignErr error) (err error) {
+	defer func(begin time.Time) {
+		_ = mw.logger.Log(
+			"method", "RecordDEPAssignResult",
+			"serial", serial,
+			"assign_err", assignErr,
+			"err", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.RecordDEPAssignResult(ctx, serial, assignErr)
+}
+
+func (mw loggingMiddleware) UpdateFromDeviceInformation(ctx context.Context, udid string, queryResponses map[string]interface{}) (err error) {
+	defer func(begin time.Time) {
+		_ = mw.logger.Log(
+			"method", "UpdateFromDeviceInformation",
+			"udid", udid,
+			"query_responses", len(queryResponses),
+			"err", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.UpdateFromDeviceInformation(ctx, udid, queryResponses)
+}
+
+func (mw loggingMiddleware) WithTx(ctx context.Context, fn func(tx Store) error) (err error) {
+	defer func(begin time.Time) {
+		_ = mw.logger.Log(
+			"method", "WithTx",
+			"err", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.WithTx(ctx, func(tx Store) error {
+		return fn(loggingMiddleware{next: tx, logger: mw.logger})
+	})
+}
+
+func (mw loggingMiddleware) DeviceExists(ctx context.Context, serial string) (exists bool, err error) {
+	defer func(begin time.Time) {
+		_ = mw.logger.Log(
+			"method", "DeviceExists",
+			"serial", serial,
+			"exists", exists,
+			"err", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.DeviceExists(ctx, serial)
+}
+
+func (mw loggingMiddleware) ReapUnenrolled(ctx context.Context, olderThan time.Time) (n int, err error) {
+	defer func(begin time.Time) {
+		_ = mw.logger.Log(
+			"method", "ReapUnenrolled",
+			"older_than", olderThan,
+			"reaped", n,
+			"err", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.ReapUnenrolled(ctx, olderThan)
+}
+
+func (mw loggingMiddleware) ExportDevices(ctx context.Context, w io.Writer) (err error) {
+	defer func(begin time.Time) {
+		_ = mw.logger.Log(
+			"method", "ExportDevices",
+			"err", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.ExportDevices(ctx, w)
+}
+
+func (mw loggingMiddleware) ImportDevices(ctx context.Context, r io.Reader) (n int, err error) {
+	defer func(begin time.Time) {
+		_ = mw.logger.Log(
+			"method", "ImportDevices",
+			"imported", n,
+			"err", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.ImportDevices(ctx, r)
+}
+
+func (mw loggingMiddleware) Upsert(ctx context.Context, dev *device.Device) (created bool, err error) {
+	defer func(begin time.Time) {
+		_ = mw.logger.Log(
+			"method", "Upsert",
+			"uuid", dev.UUID,
+			"created", created,
+			"err", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.Upsert(ctx, dev)
+}
+
+func (mw loggingMiddleware) ClearDEPProfile(ctx context.Context, serial string) (err error) {
+	defer func(begin time.Time) {
+		_ = mw.logger.Log(
+			"method", "ClearDEPProfile",
+			"serial", serial,
+			"err", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.ClearDEPProfile(ctx, serial)
+}
+
+func (mw loggingMiddleware) Ping(ctx context.Context) (err error) {
+	defer func(begin time.Time) {
+		_ = mw.logger.Log(
+			"method", "Ping",
+			"err", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.Ping(ctx)
+}
+
+func (mw loggingMiddleware) Close() (err error) {
+	defer func(begin time.Time) {
+		_ = mw.logger.Log(
+			"method", "Close",
+			"err", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.Close()
+}
+
+func (mw loggingMiddleware) SetAwaitingConfiguration(ctx context.Context, udid string, awaiting bool) (err error) {
+	defer func(begin time.Time) {
+		_ = mw.logger.Log(
+			"method", "SetAwaitingConfiguration",
+			"udid", udid,
+			"awaiting", awaiting,
+			"err", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.SetAwaitingConfiguration(ctx, udid, awaiting)
+}
+
+func (mw loggingMiddleware) CountByModel(ctx context.Context) (counts map[string]int, err error) {
+	defer func(begin time.Time) {
+		_ = mw.logger.Log(
+			"method", "CountByModel",
+			"models", len(counts),
+			"err", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.CountByModel(ctx)
+}
+
+func (mw loggingMiddleware) DistinctValues(ctx context.Context, column string) (values []string, err error) {
+	defer func(begin time.Time) {
+		_ = mw.logger.Log(
+			"method", "DistinctValues",
+			"column", column,
+			"values", len(values),
+			"err", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.DistinctValues(ctx, column)
+}
+
+func (mw loggingMiddleware) AddTags(ctx context.Context, deviceUUID string, tags ...string) (err error) {
+	defer func(begin time.Time) {
+		_ = mw.logger.Log(
+			"method", "AddTags",
+			"uuid", deviceUUID,
+			"tags", strings.Join(tags, ","),
+			"err", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.AddTags(ctx, deviceUUID, tags...)
+}
+
+func (mw loggingMiddleware) RemoveTags(ctx context.Context, deviceUUID string, tags ...string) (err error) {
+	defer func(begin time.Time) {
+		_ = mw.logger.Log(
+			"method", "RemoveTags",
+			"uuid", deviceUUID,
+			"tags", strings.Join(tags, ","),
+			"err", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.RemoveTags(ctx, deviceUUID, tags...)
+}
+
+func (mw loggingMiddleware) SaveManualEnrollment(ctx context.Context, dev *device.Device) (uuid string, err error) {
+	defer func(begin time.Time) {
+		_ = mw.logger.Log(
+			"method", "SaveManualEnrollment",
+			"udid", dev.UDID,
+			"uuid", uuid,
+			"err", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.SaveManualEnrollment(ctx, dev)
+}
+
+func (mw loggingMiddleware) DevicesIter(ctx context.Context, params ...interface{}) (rows *DeviceRows, err error) {
+	defer func(begin time.Time) {
+		_ = mw.logger.Log(
+			"method", "DevicesIter",
+			"param_count", len(params),
+			"err", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.DevicesIter(ctx, params...)
+}
+
+func (mw loggingMiddleware) UpdateDEPStatusBySerials(ctx context.Context, status device.DEPProfileStatus, serials []string) (n int, err error) {
+	defer func(begin time.Time) {
+		_ = mw.logger.Log(
+			"method", "UpdateDEPStatusBySerials",
+			"status", status,
+			"serials", len(serials),
+			"err", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.UpdateDEPStatusBySerials(ctx, status, serials)
+}
+
+func (mw loggingMiddleware) RecordPush(ctx context.Context, udid string, pushErr error) (err error) {
+	defer func(begin time.Time) {
+		_ = mw.logger.Log(
+			"method", "RecordPush",
+			"udid", udid,
+			"push_err", pushErr,
+			"err", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.RecordPush(ctx, udid, pushErr)
+}
+
+func (mw loggingMiddleware) FindDuplicateSerials(ctx context.Context) (duplicates map[string][]string, err error) {
+	defer func(begin time.Time) {
+		_ = mw.logger.Log(
+			"method", "FindDuplicateSerials",
+			"duplicate_count", len(duplicates),
+			"err", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.FindDuplicateSerials(ctx)
+}
+
+func (mw loggingMiddleware) DeviceByAssetTag(ctx context.Context, tag string) (dev *device.Device, err error) {
+	defer func(begin time.Time) {
+		_ = mw.logger.Log(
+			"method", "DeviceByAssetTag",
+			"asset_tag", tag,
+			"err", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.DeviceByAssetTag(ctx, tag)
+}
+
+func (mw loggingMiddleware) DEPAssignmentHistory(ctx context.Context, deviceUUID string) (history []DEPAssignment, err error) {
+	defer func(begin time.Time) {
+		_ = mw.logger.Log(
+			"method", "DEPAssignmentHistory",
+			"device_uuid", deviceUUID,
+			"history_count", len(history),
+			"err", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.DEPAssignmentHistory(ctx, deviceUUID)
+}
+
+func (mw loggingMiddleware) ClaimDevicesForPush(ctx context.Context, limit int) (devices []device.Device, err error) {
+	defer func(begin time.Time) {
+		_ = mw.logger.Log(
+			"method", "ClaimDevicesForPush",
+			"limit", limit,
+			"claimed", len(devices),
+			"err", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.ClaimDevicesForPush(ctx, limit)
+}
+
+func (mw loggingMiddleware) MergeDevices(ctx context.Context, keepUUID, mergeUUID string) (err error) {
+	defer func(begin time.Time) {
+		_ = mw.logger.Log(
+			"method", "MergeDevices",
+			"keep_uuid", keepUUID,
+			"merge_uuid", mergeUUID,
+			"err", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.MergeDevices(ctx, keepUUID, mergeUUID)
+}
+
+func (mw loggingMiddleware) DevicesByDEPProfile(ctx context.Context) (byProfile map[string][]device.Device, err error) {
+	defer func(begin time.Time) {
+		_ = mw.logger.Log(
+			"method", "DevicesByDEPProfile",
+			"profile_count", len(byProfile),
+			"err", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.DevicesByDEPProfile(ctx)
+}
+
+func (mw loggingMiddleware) RetargetWorkflow(ctx context.Context, oldUUID, newUUID string) (n int, err error) {
+	defer func(begin time.Time) {
+		_ = mw.logger.Log(
+			"method", "RetargetWorkflow",
+			"old_workflow_uuid", oldUUID,
+			"new_workflow_uuid", newUUID,
+			"retargeted", n,
+			"err", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.RetargetWorkflow(ctx, oldUUID, newUUID)
+}
+
+func (mw loggingMiddleware) DevicesAfter(ctx context.Context, afterUUID string, limit int) (devices []device.Device, err error) {
+	defer func(begin time.Time) {
+		_ = mw.logger.Log(
+			"method", "DevicesAfter",
+			"after_uuid", afterUUID,
+			"limit", limit,
+			"device_count", len(devices),
+			"err", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.DevicesAfter(ctx, afterUUID, limit)
+}
+
+func (mw loggingMiddleware) DEPAssignmentsByDay(ctx context.Context, since time.Time) (counts map[string]int, err error) {
+	defer func(begin time.Time) {
+		_ = mw.logger.Log(
+			"method", "DEPAssignmentsByDay",
+			"since", since,
+			"err", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.DEPAssignmentsByDay(ctx, since)
+}
+
+func (mw loggingMiddleware) ResetEnrollment(ctx context.Context, serial string) (err error) {
+	defer func(begin time.Time) {
+		_ = mw.logger.Log(
+			"method", "ResetEnrollment",
+			"serial", serial,
+			"err", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.ResetEnrollment(ctx, serial)
+}
+
+func (mw loggingMiddleware) SetAttribute(ctx context.Context, deviceUUID, key string, value interface{}) (err error) {
+	defer func(begin time.Time) {
+		_ = mw.logger.Log(
+			"method", "SetAttribute",
+			"device_uuid", deviceUUID,
+			"key", key,
+			"err", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.SetAttribute(ctx, deviceUUID, key, value)
+}
+
+func (mw loggingMiddleware) GetAttributes(ctx context.Context, deviceUUID string) (attributes map[string]interface{}, err error) {
+	defer func(begin time.Time) {
+		_ = mw.logger.Log(
+			"method", "GetAttributes",
+			"device_uuid", deviceUUID,
+			"attribute_count", len(attributes),
+			"err", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	return mw.next.GetAttributes(ctx, deviceUUID)
+}
@@ -0,0 +1,289 @@
+package pg
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/go-kit/kit/metrics"
+
+	"github.com/micromdm/micromdm/platform/device"
+)
+
+// MetricsMiddleware records the number of calls, errors and the latency in seconds of every Store method.
+// Metrics are labeled with "method", and calls and latency are also labeled with "error" ("true" or "false").
+// Use the go-kit prometheus package to create Prometheus backed metrics.
+func MetricsMiddleware(calls, errs metrics.Counter, latency metrics.Histogram) Middleware {
+	return func(next Store) Store {
+		return metricsMiddleware{
+			next:    next,
+			calls:   calls,
+			errs:    errs,
+			latency: latency,
+		}
+	}
+}
+
+type metricsMiddleware struct {
+	next    Store
+	calls   metrics.Counter
+	errs    metrics.Counter
+	latency metrics.Histogram
+}
+
+func (mw metricsMiddleware) observe(method string, begin time.Time, err error) {
+	lvs := []string{"method", method, "error", fmt.Sprint(err != nil)}
+	mw.calls.With(lvs...).Add(1)
+	mw.latency.With(lvs...).Observe(time.Since(begin).Seconds())
+	if err != nil {
+		mw.errs.With("method", method).Add(1)
+	}
+}
+
+func (mw metricsMiddleware) Save(ctx context.Context, dev *device.Device) (err error) {
+	defer func(begin time.Time) { mw.observe("Save", begin, err) }(time.Now())
+	return mw.next.Save(ctx, dev)
+}
+
+func (mw metricsMiddleware) BulkSave(ctx context.Context, devices []*device.Device) (err error) {
+	defer func(begin time.Time) { mw.observe("BulkSave", begin, err) }(time.Now())
+	return mw.next.BulkSave(ctx, devices)
+}
+
+func (mw metricsMiddleware) UpdateDevice(ctx context.Context, dev *device.Device) (err error) {
+	defer func(begin time.Time) { mw.observe("UpdateDevice", begin, err) }(time.Now())
+	return mw.next.UpdateDevice(ctx, dev)
+}
+
+func (mw metricsMiddleware) AssignWorkflow(ctx context.Context, deviceUUIDs []string, workflowUUID string) (n int, err error) {
+	defer func(begin time.Time) { mw.observe("AssignWorkflow", begin, err) }(time.Now())
+	return mw.next.AssignWorkflow(ctx, deviceUUIDs, workflowUUID)
+}
+
+func (mw metricsMiddleware) DeviceByUDID(ctx context.Context, udid string) (dev *device.Device, err error) {
+	defer func(begin time.Time) { mw.observe("DeviceByUDID", begin, err) }(time.Now())
+	return mw.next.DeviceByUDID(ctx, udid)
+}
+
+func (mw metricsMiddleware) DeviceBySerial(ctx context.Context, serial string) (dev *device.Device, err error) {
+	defer func(begin time.Time) { mw.observe("DeviceBySerial", begin, err) }(time.Now())
+	return mw.next.DeviceBySerial(ctx, serial)
+}
+
+func (mw metricsMiddleware) DeviceByIMEI(ctx context.Context, imei string) (dev *device.Device, err error) {
+	defer func(begin time.Time) { mw.observe("DeviceByIMEI", begin, err) }(time.Now())
+	return mw.next.DeviceByIMEI(ctx, imei)
+}
+
+func (mw metricsMiddleware) DeviceByMEID(ctx context.Context, meid string) (dev *device.Device, err error) {
+	defer func(begin time.Time) { mw.observe("DeviceByMEID", begin, err) }(time.Now())
+	return mw.next.DeviceByMEID(ctx, meid)
+}
+
+func (mw metricsMiddleware) DeviceByPushToken(ctx context.Context, token string) (dev *device.Device, err error) {
+	defer func(begin time.Time) { mw.observe("DeviceByPushToken", begin, err) }(time.Now())
+	return mw.next.DeviceByPushToken(ctx, token)
+}
+
+func (mw metricsMiddleware) ListDevices(ctx context.Context, opt device.ListDevicesOption) (devices []device.Device, err error) {
+	defer func(begin time.Time) { mw.observe("ListDevices", begin, err) }(time.Now())
+	return mw.next.ListDevices(ctx, opt)
+}
+
+func (mw metricsMiddleware) Devices(ctx context.Context, params ...interface{}) (devices []device.Device, err error) {
+	defer func(begin time.Time) { mw.observe("Devices", begin, err) }(time.Now())
+	return mw.next.Devices(ctx, params...)
+}
+
+func (mw metricsMiddleware) CountDevices(ctx context.Context, params ...interface{}) (n int, err error) {
+	defer func(begin time.Time) { mw.observe("CountDevices", begin, err) }(time.Now())
+	return mw.next.CountDevices(ctx, params...)
+}
+
+func (mw metricsMiddleware) PushableDevices(ctx context.Context) (devices []device.Device, err error) {
+	defer func(begin time.Time) { mw.observe("PushableDevices", begin, err) }(time.Now())
+	return mw.next.PushableDevices(ctx)
+}
+
+func (mw metricsMiddleware) DeleteDevice(ctx context.Context, uuid string) (err error) {
+	defer func(begin time.Time) { mw.observe("DeleteDevice", begin, err) }(time.Now())
+	return mw.next.DeleteDevice(ctx, uuid)
+}
+
+func (mw metricsMiddleware) DeleteByUDID(ctx context.Context, udid string) (err error) {
+	defer func(begin time.Time) { mw.observe("DeleteByUDID", begin, err) }(time.Now())
+	return mw.next.DeleteByUDID(ctx, udid)
+}
+
+func (mw metricsMiddleware) DeleteBySerial(ctx context.Context, serial string) (err error) {
+	defer func(begin time.Time) { mw.observe("DeleteBySerial", begin, err) }(time.Now())
+	return mw.next.DeleteBySerial(ctx, serial)
+}
+
+func (mw metricsMiddleware) Search(ctx context.Context, term string, limit int) (devices []device.Device, err error) {
+	defer func(begin time.Time) { mw.observe("Search", begin, err) }(time.Now())
+	return mw.next.Search(ctx, term, limit)
+}
+
+func (mw metricsMiddleware) RecordDEPAssignResult(ctx context.Context, serial string, assignErr error) (err error) {
+	defer func(begin time.Time) { mw.observe("RecordDEPAssignResult", begin, err) }(time.Now())
+	return mw.next.RecordDEPAssignResult(ctx, serial, assignErr)
+}
+
+func (mw metricsMiddleware) UpdateFromDeviceInformation(ctx context.Context, udid string, queryResponses map[string]interface{}) (err error) {
+	defer func(begin time.Time) { mw.observe("UpdateFromDeviceInformation", begin, err) }(time.Now())
+	return mw.next.UpdateFromDeviceInformation(ctx, udid, queryResponses)
+}
+
+func (mw metricsMiddleware) WithTx(ctx context.Context, fn func(tx Store) error) (err error) {
+	defer func(begin time.Time) { mw.observe("WithTx", begin, err) }(time.Now())
+	return mw.next.WithTx(ctx, func(tx Store) error {
+		return fn(metricsMiddleware{next: tx, calls: mw.calls, errs: mw.errs, latency: mw.latency})
+	})
+}
+
+func (mw metricsMiddleware) DeviceExists(ctx context.Context, serial string) (exists bool, err error) {
+	defer func(begin time.Time) { mw.observe("DeviceExists", begin, err) }(time.Now())
+	return mw.next.DeviceExists(ctx, serial)
+}
+
+func (mw metricsMiddleware) ReapUnenrolled(ctx context.Context, olderThan time.Time) (n int, err error) {
+	defer func(begin time.Time) { mw.observe("ReapUnenrolled", begin, err) }(time.Now())
+	return mw.next.ReapUnenrolled(ctx, olderThan)
+}
+
+func (mw metricsMiddleware) ExportDevices(ctx context.Context, w io.Writer) (err error) {
+	defer func(begin time.Time) { mw.observe("ExportDevices", begin, err) }(time.Now())
+	return mw.next.ExportDevices(ctx, w)
+}
+
+func (mw metricsMiddleware) ImportDevices(ctx context.Context, r io.Reader) (n int, err error) {
+	defer func(begin time.Time) { mw.observe("ImportDevices", begin, err) }(time.Now())
+	return mw.next.ImportDevices(ctx, r)
+}
+
+func (mw metricsMiddleware) Upsert(ctx context.Context, dev *device.Device) (created bool, err error) {
+	defer func(begin time.Time) { mw.observe("Upsert", begin, err) }(time.Now())
+	return mw.next.Upsert(ctx, dev)
+}
+
+func (mw metricsMiddleware) ClearDEPProfile(ctx context.Context, serial string) (err error) {
+	defer func(begin time.Time) { mw.observe("ClearDEPProfile", begin, err) }(time.Now())
+	return mw.next.ClearDEPProfile(ctx, serial)
+}
+
+func (mw metricsMiddleware) Ping(ctx context.Context) (err error) {
+	defer func(begin time.Time) { mw.observe("Ping", begin, err) }(time.Now())
+	return mw.next.Ping(ctx)
+}
+
+func (mw metricsMiddleware) Close() (err error) {
+	defer func(begin time.Time) { mw.observe("Close", begin, err) }(time.Now())
+	return mw.next.Close()
+}
+
+func (mw metricsMiddleware) SetAwaitingConfiguration(ctx context.Context, udid string, awaiting bool) (err error) {
+	defer func(begin time.Time) { mw.observe("SetAwaitingConfiguration", begin, err) }(time.Now())
+	return mw.next.SetAwaitingConfiguration(ctx, udid, awaiting)
+}
+
+func (mw metricsMiddleware) CountByModel(ctx context.Context) (counts map[string]int, err error) {
+	defer func(begin time.Time) { mw.observe("CountByModel", begin, err) }(time.Now())
+	return mw.next.CountByModel(ctx)
+}
+
+func (mw metricsMiddleware) DistinctValues(ctx context.Context, column string) (values []string, err error) {
+	defer func(begin time.Time) { mw.observe("DistinctValues", begin, err) }(time.Now())
+	return mw.next.DistinctValues(ctx, column)
+}
+
+func (mw metricsMiddleware) AddTags(ctx context.Context, deviceUUID string, tags ...string) (err error) {
+	defer func(begin time.Time) { mw.observe("AddTags", begin, err) }(time.Now())
+	return mw.next.AddTags(ctx, deviceUUID, tags...)
+}
+
+func (mw metricsMiddleware) RemoveTags(ctx context.Context, deviceUUID string, tags ...string) (err error) {
+	defer func(begin time.Time) { mw.observe("RemoveTags", begin, err) }(time.Now())
+	return mw.next.RemoveTags(ctx, deviceUUID, tags...)
+}
+
+func (mw metricsMiddleware) SaveManualEnrollment(ctx context.Context, dev *device.Device) (uuid string, err error) {
+	defer func(begin time.Time) { mw.observe("SaveManualEnrollment", begin, err) }(time.Now())
+	return mw.next.SaveManualEnrollment(ctx, dev)
+}
+
+func (mw metricsMiddleware) DevicesIter(ctx context.Context, params ...interface{}) (rows *DeviceRows, err error) {
+	defer func(begin time.Time) { mw.observe("DevicesIter", begin, err) }(time.Now())
+	return mw.next.DevicesIter(ctx, params...)
+}
+
+func (mw metricsMiddleware) UpdateDEPStatusBySerials(ctx context.Context, status device.DEPProfileStatus, serials []string) (n int, err error) {
+	defer func(begin time.Time) { mw.observe("UpdateDEPStatusBySerials", begin, err) }(time.Now())
+	return mw.next.UpdateDEPStatusBySerials(ctx, status, serials)
+}
+
+func (mw metricsMiddleware) RecordPush(ctx context.Context, udid string, pushErr error) (err error) {
+	defer func(begin time.Time) { mw.observe("RecordPush", begin, err) }(time.Now())
+	return mw.next.RecordPush(ctx, udid, pushErr)
+}
+
+func (mw metricsMiddleware) FindDuplicateSerials(ctx context.Context) (duplicates map[string][]string, err error) {
+	defer func(begin time.Time) { mw.observe("FindDuplicateSerials", begin, err) }(time.Now())
+	return mw.next.FindDuplicateSerials(ctx)
+}
+
+func (mw metricsMiddleware) DeviceByAssetTag(ctx context.Context, tag string) (dev *device.Device, err error) {
+	defer func(begin time.Time) { mw.observe("DeviceByAssetTag", begin, err) }(time.Now())
+	return mw.next.DeviceByAssetTag(ctx, tag)
+}
+
+func (mw metricsMiddleware) DEPAssignmentHistory(ctx context.Context, deviceUUID string) (history []DEPAssignment, err error) {
+	defer func(begin time.Time) { mw.observe("DEPAssignmentHistory", begin, err) }(time.Now())
+	return mw.next.DEPAssignmentHistory(ctx, deviceUUID)
+}
+
+func (mw metricsMiddleware) ClaimDevicesForPush(ctx context.Context, limit int) (devices []device.Device, err error) {
+	defer func(begin time.Time) { mw.observe("ClaimDevicesForPush", begin, err) }(time.Now())
+	return mw.next.ClaimDevicesForPush(ctx, limit)
+}
+
+func (mw metricsMiddleware) MergeDevices(ctx context.Context, keepUUID, mergeUUID string) (err error) {
+	defer func(begin time.Time) { mw.observe("MergeDevices", begin, err) }(time.Now())
+	return mw.next.MergeDevices(ctx, keepUUID, mergeUUID)
+}
+
+func (mw metricsMiddleware) DevicesByDEPProfile(ctx context.Context) (byProfile map[string][]device.Device, err error) {
+	defer func(begin time.Time) { mw.observe("DevicesByDEPProfile", begin, err) }(time.Now())
+	return mw.next.DevicesByDEPProfile(ctx)
+}
+
+func (mw metricsMiddleware) RetargetWorkflow(ctx context.Context, oldUUID, newUUID string) (n int, err error) {
+	defer func(begin time.Time) { mw.observe("RetargetWorkflow", begin, err) }(time.Now())
+	return mw.next.RetargetWorkflow(ctx, oldUUID, newUUID)
+}
+
+func (mw metricsMiddleware) DevicesAfter(ctx context.Context, afterUUID string, limit int) (devices []device.Device, err error) {
+	defer func(begin time.Time) { mw.observe("DevicesAfter", begin, err) }(time.Now())
+	return mw.next.DevicesAfter(ctx, afterUUID, limit)
+}
+
+func (mw metricsMiddleware) DEPAssignmentsByDay(ctx context.Context, since time.Time) (counts map[string]int, err error) {
+	defer func(begin time.Time) { mw.observe("DEPAssignmentsByDay", begin, err) }(time.Now())
+	return mw.next.DEPAssignmentsByDay(ctx, since)
+}
+
+func (mw metricsMiddleware) ResetEnrollment(ctx context.Context, serial string) (err error) {
+	defer func(begin time.Time) { mw.observe("ResetEnrollment", begin, err) }(time.Now())
+	return mw.next.ResetEnrollment(ctx, serial)
+}
+
+func (mw metricsMiddleware) SetAttribute(ctx context.Context, deviceUUID, key string, value interface{}) (err error) {
+	defer func(begin time.Time) { mw.observe("SetAttribute", begin, err) }(time.Now())
+	return mw.next.SetAttribute(ctx, deviceUUID, key, value)
+}
+
+func (mw metricsMiddleware) GetAttributes(ctx context.Context, deviceUUID string) (attributes map[string]interface{}, err error) {
+	defer func(begin time.Time) { mw.observe("GetAttributes", begin, err) }(time.Now())
+	return mw.next.GetAttributes(ctx, deviceUUID)
+}
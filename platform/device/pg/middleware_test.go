@@ -0,0 +1,197 @@
+package pg
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/metrics"
+	"github.com/go-kit/kit/metrics/discard"
+
+	"github.com/micromdm/micromdm/platform/device"
+)
+
+func TestMetricsMiddleware(t *testing.T) {
+	calls, errs := newTestCounter(), newTestCounter()
+	store := MetricsMiddleware(calls, errs, discard.NewHistogram())(stubStore{})
+
+	ctx := context.Background()
+	if _, err := store.Devices(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Devices(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.DeviceByUDID(ctx, "foo"); err == nil {
+		t.Fatal("expected error from stub DeviceByUDID")
+	}
+
+	if have, want := calls.value("method", "Devices", "error", "false"), 2.0; have != want {
+		t.Errorf("Devices calls: have %v, want %v", have, want)
+	}
+	if have, want := calls.value("method", "DeviceByUDID", "error", "true"), 1.0; have != want {
+		t.Errorf("DeviceByUDID calls: have %v, want %v", have, want)
+	}
+	if have, want := errs.value("method", "DeviceByUDID"), 1.0; have != want {
+		t.Errorf("DeviceByUDID errors: have %v, want %v", have, want)
+	}
+	if have, want := errs.value("method", "Devices"), 0.0; have != want {
+		t.Errorf("Devices errors: have %v, want %v", have, want)
+	}
+}
+
+func TestLoggingMiddleware(t *testing.T) {
+	var buf bytes.Buffer
+	store := LoggingMiddleware(log.NewLogfmtLogger(&buf))(stubStore{})
+
+	ctx := context.Background()
+	if err := store.Save(ctx, &device.Device{UUID: "foo", UDID: "UDID-foo", SerialNumber: "C02FOO"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.DeviceByUDID(ctx, "UDID-bar"); err == nil {
+		t.Fatal("expected error from stub DeviceByUDID")
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if have, want := len(lines), 2; have != want {
+		t.Fatalf("have %d log lines, want %d:\n%s", have, want, buf.String())
+	}
+	for _, want := range []string{"method=Save", "uuid=foo", "udid=UDID-foo", "serial=C02FOO", "err=null", "took="} {
+		if !strings.Contains(lines[0], want) {
+			t.Errorf("Save log line %q missing %q", lines[0], want)
+		}
+	}
+	for _, want := range []string{"method=DeviceByUDID", "udid=UDID-bar", `err="device not found"`} {
+		if !strings.Contains(lines[1], want) {
+			t.Errorf("DeviceByUDID log line %q missing %q", lines[1], want)
+		}
+	}
+
+	buf.Reset()
+	const token = "d3ad6e3f9c2b4a1e8f7d6c5b4a3e2f1d"
+	if _, err := store.DeviceByPushToken(ctx, token); err == nil {
+		t.Fatal("expected error from stub DeviceByPushToken")
+	}
+	if strings.Contains(buf.String(), token) || !strings.Contains(buf.String(), "token=****2f1d") {
+		t.Errorf("DeviceByPushToken log line does not redact the token: %s", buf.String())
+	}
+}
+
+func TestLoggingMiddlewareSlowQueryThreshold(t *testing.T) {
+	ctx := context.Background()
+	call := func(store Store) {
+		t.Helper()
+		if err := store.Save(ctx, &device.Device{UUID: "foo", UDID: "UDID-foo"}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := store.Devices(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var buf bytes.Buffer
+	call(LoggingMiddleware(log.NewLogfmtLogger(&buf), WithSlowQueryThreshold(0))(stubStore{}))
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if have, want := len(lines), 2; have != want {
+		t.Fatalf("have %d log lines, want %d:\n%s", have, want, buf.String())
+	}
+	for i, method := range []string{"Save", "Devices"} {
+		for _, want := range []string{"level=warn", "method=" + method, "took="} {
+			if !strings.Contains(lines[i], want) {
+				t.Errorf("%s log line %q missing %q", method, lines[i], want)
+			}
+		}
+	}
+
+	buf.Reset()
+	call(LoggingMiddleware(log.NewLogfmtLogger(&buf), WithSlowQueryThreshold(time.Hour))(stubStore{}))
+	if buf.Len() != 0 {
+		t.Errorf("fast calls were logged:\n%s", buf.String())
+	}
+}
+
+func TestMiddlewareWithTx(t *testing.T) {
+	var buf bytes.Buffer
+	calls, errs := newTestCounter(), newTestCounter()
+	store := LoggingMiddleware(log.NewLogfmtLogger(&buf))(stubStore{})
+	store = MetricsMiddleware(calls, errs, discard.NewHistogram())(store)
+
+	ctx := context.Background()
+	err := store.WithTx(ctx, func(tx Store) error {
+		return tx.Save(ctx, &device.Device{UUID: "foo", UDID: "UDID-foo"})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if have, want := len(lines), 2; have != want {
+		t.Fatalf("have %d log lines, want %d:\n%s", have, want, buf.String())
+	}
+	for i, method := range []string{"Save", "WithTx"} {
+		if !strings.Contains(lines[i], "method="+method) {
+			t.Errorf("log line %q missing method=%s", lines[i], method)
+		}
+	}
+	for _, method := range []string{"Save", "WithTx"} {
+		if have, want := calls.value("method", method, "error", "false"), 1.0; have != want {
+			t.Errorf("%s calls: have %v, want %v", method, have, want)
+		}
+	}
+}
+
+// stubStore accepts Save, returns an empty device list from Devices and ErrNotFound from DeviceByUDID
+// and DeviceByPushToken. WithTx calls fn with the stub itself.
+// Other methods panic.
+type stubStore struct{ Store }
+
+func (stubStore) Save(ctx context.Context, dev *device.Device) error {
+	return nil
+}
+
+func (s stubStore) WithTx(ctx context.Context, fn func(tx Store) error) error {
+	return fn(s)
+}
+
+func (stubStore) Devices(ctx context.Context, params ...interface{}) ([]device.Device, error) {
+	return []device.Device{}, nil
+}
+
+func (stubStore) DeviceByUDID(ctx context.Context, udid string) (*device.Device, error) {
+	return nil, ErrNotFound
+}
+
+func (stubStore) DeviceByPushToken(ctx context.Context, token string) (*device.Device, error) {
+	return nil, ErrNotFound
+}
+
+// testCounter records the values added to it, keyed by label values.
+type testCounter struct {
+	mu     *sync.Mutex
+	values map[string]float64
+	lvs    []string
+}
+
+func newTestCounter() *testCounter {
+	return &testCounter{mu: new(sync.Mutex), values: make(map[string]float64)}
+}
+
+func (c *testCounter) With(labelValues ...string) metrics.Counter {
+	return &testCounter{mu: c.mu, values: c.values, lvs: append(append([]string{}, c.lvs...), labelValues...)}
+}
+
+func (c *testCounter) Add(delta float64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[strings.Join(c.lvs, ",")] += delta
+}
+
+func (c *testCounter) value(labelValues ...string) float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.values[strings.Join(labelValues, ",")]
+}
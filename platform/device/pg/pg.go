@@ -3,19 +3,234 @@ package pg
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
+	"io"
 	"strings"
+	"time"
 
 	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
 	"github.com/pkg/errors"
 	sq "gopkg.in/Masterminds/squirrel.v1"
 
 	"github.com/micromdm/micromdm/platform/device"
 )
 
-type Postgres struct{ db *sqlx.DB }
+// Store is the set of device methods implemented by Postgres.
+// Middlewares in this package wrap a Store.
+type Store interface {
+	Save(ctx context.Context, dev *device.Device) error
+	BulkSave(ctx context.Context, devices []*device.Device) error
+	UpdateDevice(ctx context.Context, dev *device.Device) error
+	AssignWorkflow(ctx context.Context, deviceUUIDs []string, workflowUUID string) (int, error)
+	DeviceByUDID(ctx context.Context, udid string) (*device.Device, error)
+	DeviceBySerial(ctx context.Context, serial string) (*device.Device, error)
+	DeviceByIMEI(ctx context.Context, imei string) (*device.Device, error)
+	DeviceByMEID(ctx context.Context, meid string) (*device.Device, error)
+	DeviceByPushToken(ctx context.Context, token string) (*device.Device, error)
+	ListDevices(ctx context.Context, opt device.ListDevicesOption) ([]device.Device, error)
+	Devices(ctx context.Context, params ...interface{}) ([]device.Device, error)
+	CountDevices(ctx context.Context, params ...interface{}) (int, error)
+	PushableDevices(ctx context.Context) ([]device.Device, error)
+	DeleteDevice(ctx context.Context, uuid string) error
+	DeleteByUDID(ctx context.Context, udid string) error
+	DeleteBySerial(ctx context.Context, serial string) error
+	Search(ctx context.Context, term string, limit int) ([]device.Device, error)
+	RecordDEPAssignResult(ctx context.Context, serial string, assignErr error) error
+	UpdateFromDeviceInformation(ctx context.Context, udid string, queryResponses map[string]interface{}) error
+	WithTx(ctx context.Context, fn func(tx Store) error) error
+	DeviceExists(ctx context.Context, serial string) (bool, error)
+	ReapUnenrolled(ctx context.Context, olderThan time.Time) (int, error)
+	ExportDevices(ctx context.Context, w io.Writer) error
+	ImportDevices(ctx context.Context, r io.Reader) (int, error)
+	Upsert(ctx context.Context, dev *device.Device) (bool, error)
+	ClearDEPProfile(ctx context.Context, serial string) error
+	Ping(ctx context.Context) error
+	Close() error
+	SetAwaitingConfiguration(ctx context.Context, udid string, awaiting bool) error
+	CountByModel(ctx context.Context) (map[string]int, error)
+	DistinctValues(ctx context.Context, column string) ([]string, error)
+	AddTags(ctx context.Context, deviceUUID string, tags ...string) error
+	RemoveTags(ctx context.Context, deviceUUID string, tags ...string) error
+	SaveManualEnrollment(ctx context.Context, dev *device.Device) (string, error)
+	DevicesIter(ctx context.Context, params ...interface{}) (*DeviceRows, error)
+	UpdateDEPStatusBySerials(ctx context.Context, status device.DEPProfileStatus, serials []string) (int, error)
+	RecordPush(ctx context.Context, udid string, pushErr error) error
+	FindDuplicateSerials(ctx context.Context) (map[string][]string, error)
+	DeviceByAssetTag(ctx context.Context, tag string) (*device.Device, error)
+	DEPAssignmentHistory(ctx context.Context, deviceUUID string) ([]DEPAssignment, error)
+	ClaimDevicesForPush(ctx context.Context, limit int) ([]device.Device, error)
+	MergeDevices(ctx context.Context, keepUUID, mergeUUID string) error
+	DevicesByDEPProfile(ctx context.Context) (map[string][]device.Device, error)
+	RetargetWorkflow(ctx context.Context, oldUUID, newUUID string) (int, error)
+	DevicesAfter(ctx context.Context, afterUUID string, limit int) ([]device.Device, error)
+	DEPAssignmentsByDay(ctx context.Context, since time.Time) (map[string]int, error)
+	ResetEnrollment(ctx context.Context, serial string) error
+	SetAttribute(ctx context.Context, deviceUUID, key string, value interface{}) error
+	GetAttributes(ctx context.Context, deviceUUID string) (map[string]interface{}, error)
+}
+
+// Middleware decorates a Store.
+type Middleware func(Store) Store
+
+type Postgres struct {
+	db      *sqlx.DB
+	replica *sqlx.DB
+	tx      *sqlx.Tx // set for the Store passed to a WithTx callback
+
+	table, tagTable, historyTable, pushInfoTable string
+	timeout                                      time.Duration
+	batchSize                                    int
+	monitor                                      *healthMonitor
+}
+
+var _ Store = (*Postgres)(nil)
+
+type Option func(*Postgres)
+
+// WithReadReplica sends the queries of read only methods, like Devices, DeviceByUDID
+// and CountDevices, to replica instead of the primary database.
+// Reads from a replica can lag behind writes to the primary.
+func WithReadReplica(replica *sqlx.DB) Option {
+	return func(d *Postgres) {
+		d.replica = replica
+	}
+}
+
+// WithPool sizes the connection pool of the primary database: at most maxOpen connections,
+// of which maxIdle are kept open when idle, each reused for at most maxLifetime.
+// Zero values keep the database/sql defaults, see sql.DB.SetMaxOpenConns.
+func WithPool(maxOpen, maxIdle int, maxLifetime time.Duration) Option {
+	return func(d *Postgres) {
+		if maxOpen > 0 {
+			d.db.SetMaxOpenConns(maxOpen)
+		}
+		if maxIdle > 0 {
+			d.db.SetMaxIdleConns(maxIdle)
+		}
+		if maxLifetime > 0 {
+			d.db.SetConnMaxLifetime(maxLifetime)
+		}
+	}
+}
+
+// WithBatchSize makes BulkSave commit the devices in batches of n, each in its own transaction,
+// instead of all of them in one. Large imports then hold their row locks for less time.
+func WithBatchSize(n int) Option {
+	return func(d *Postgres) {
+		d.batchSize = n
+	}
+}
+
+// WithSchema uses the device tables in the named Postgres schema instead of the ones
+// on the search_path, so that several isolated instances can share a database.
+// The schema must already exist and have been migrated.
+func WithSchema(name string) Option {
+	return func(d *Postgres) {
+		d.table = pq.QuoteIdentifier(name) + "." + tableName
+		d.tagTable = pq.QuoteIdentifier(name) + "." + tagTableName
+		d.historyTable = pq.QuoteIdentifier(name) + "." + historyTableName
+		d.pushInfoTable = pq.QuoteIdentifier(name) + "." + pushInfoTableName
+	}
+}
+
+// New returns a store using db. It does not check the schema of the devices table,
+// so a database which was not migrated fails on the first query using a missing column.
+// Use NewChecked, or call CheckSchema, to fail at startup instead.
+func New(db *sqlx.DB, opts ...Option) *Postgres {
+	d := &Postgres{
+		db:            db,
+		table:         tableName,
+		tagTable:      tagTableName,
+		historyTable:  historyTableName,
+		pushInfoTable: pushInfoTableName,
+	}
+	for _, opt := range opts {
+		opt(d)
+	}
+	if d.monitor != nil {
+		d.monitor.start()
+	}
+	return d
+}
+
+// Ping checks that the database, and the read replica if one is configured, can be reached.
+// It returns when ctx is done, so a readiness probe can bound it with a timeout.
+func (d *Postgres) Ping(ctx context.Context) error {
+	if err := d.db.PingContext(ctx); err != nil {
+		return errors.Wrap(err, "ping device database")
+	}
+	if d.replica != nil {
+		return errors.Wrap(d.replica.PingContext(ctx), "ping device database read replica")
+	}
+	return nil
+}
+
+// Close closes the database, and the read replica if one is configured.
+// Methods called after Close return an error.
+func (d *Postgres) Close() error {
+	if d.monitor != nil {
+		d.monitor.close()
+	}
+	if d.replica != nil {
+		if err := d.replica.Close(); err != nil {
+			return errors.Wrap(err, "close device database read replica")
+		}
+	}
+	return errors.Wrap(d.db.Close(), "close device database")
+}
+
+// queryer is the subset of methods shared by *sqlx.DB and *sqlx.Tx.
+type queryer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	GetContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error
+	SelectContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error
+	QueryxContext(ctx context.Context, query string, args ...interface{}) (*sqlx.Rows, error)
+}
 
-func New(db *sqlx.DB) *Postgres {
-	return &Postgres{db: db}
+// conn returns the transaction the store is scoped to, or the database if there is none.
+func (d *Postgres) conn() queryer {
+	var q queryer = d.db
+	if d.tx != nil {
+		q = d.tx
+	}
+	if d.timeout > 0 {
+		return timeoutQueryer{q: q, timeout: d.timeout}
+	}
+	return q
+}
+
+// readConn is like conn, but prefers the read replica over the primary database.
+// Reads in a transaction stay in the transaction.
+func (d *Postgres) readConn() queryer {
+	if d.tx == nil && d.replica != nil {
+		if d.timeout > 0 {
+			return timeoutQueryer{q: d.replica, timeout: d.timeout}
+		}
+		return d.replica
+	}
+	return d.conn()
+}
+
+// WithTx calls fn with a Store whose methods all run in a single transaction.
+// The transaction is committed if fn returns nil and rolled back otherwise.
+// Calling WithTx on a Store that is already scoped to a transaction reuses that transaction.
+func (d *Postgres) WithTx(ctx context.Context, fn func(tx Store) error) error {
+	if d.tx != nil {
+		return fn(d)
+	}
+	tx, err := d.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "begin device transaction")
+	}
+	defer tx.Rollback()
+
+	txStore := *d
+	txStore.tx = tx
+	if err := fn(&txStore); err != nil {
+		return err
+	}
+	return errors.Wrap(tx.Commit(), "commit device transaction")
 }
 
 func columns() []string {
@@ -46,161 +261,1294 @@ func columns() []string {
 		"dep_profile_assigned_date",
 		"dep_profile_assigned_by",
 		"last_seen",
+		"total_storage",
+		"available_storage",
+	}
+}
+
+// selectColumns returns the device columns read by queries, which are the columns written
+// by Save along with the timestamps maintained by the database.
+// Nullable columns are read with COALESCE, so rows written outside of Save with NULLs
+// scan into the zero values of the Device fields.
+func selectColumns() []string {
+	cols := append(columns(), "created_at", "updated_at")
+	for i, col := range cols {
+		if zero, ok := nullableColumns[col]; ok {
+			cols[i] = "COALESCE(" + col + ", " + zero + ") AS " + col
+		}
+	}
+	return cols
+}
+
+// nullableColumns maps the nullable device columns to the literal of their Go zero value.
+// The DEP profile times are left out, as they scan NULL into a nil *time.Time.
+var nullableColumns = map[string]string{
+	"udid":                    "''",
+	"serial_number":           "''",
+	"os_version":              "''",
+	"build_version":           "''",
+	"product_name":            "''",
+	"imei":                    "''",
+	"meid":                    "''",
+	"push_magic":              "''",
+	"awaiting_configuration":  "false",
+	"token":                   "''",
+	"unlock_token":            "''",
+	"enrolled":                "false",
+	"description":             "''",
+	"model":                   "''",
+	"model_name":              "''",
+	"device_name":             "''",
+	"color":                   "''",
+	"asset_tag":               "''",
+	"dep_profile_status":      "''",
+	"dep_profile_uuid":        "''",
+	"dep_profile_assigned_by": "''",
+	"last_seen":               zeroTimestamp,
+	"total_storage":           "0",
+	"available_storage":       "0",
+}
+
+// zeroTimestamp is the timestamp Save stores for a zero time.Time.
+const zeroTimestamp = "'0001-01-01 00:00:00'"
+
+// nullTime returns t as a column value, storing a nil or zero time as NULL.
+func nullTime(t *time.Time) interface{} {
+	if t == nil || t.IsZero() {
+		return nil
+	}
+	return *t
+}
+
+// values returns the column values of dev in the order of columns().
+func values(dev *device.Device) []interface{} {
+	return []interface{}{
+		dev.UUID,
+		dev.UDID,
+		normalizeSerial(dev.SerialNumber),
+		dev.OSVersion,
+		dev.BuildVersion,
+		dev.ProductName,
+		dev.IMEI,
+		dev.MEID,
+		dev.PushMagic,
+		dev.AwaitingConfiguration,
+		dev.Token,
+		dev.UnlockToken,
+		dev.Enrolled,
+		dev.Description,
+		dev.Model,
+		dev.ModelName,
+		dev.DeviceName,
+		dev.Color,
+		dev.AssetTag,
+		dev.DEPProfileStatus,
+		dev.DEPProfileUUID,
+		nullTime(dev.DEPProfileAssignTime),
+		nullTime(dev.DEPProfilePushTime),
+		nullTime(dev.DEPProfileAssignedDate),
+		dev.DEPProfileAssignedBy,
+		dev.LastSeen,
+		dev.TotalStorage,
+		dev.AvailableStorage,
 	}
 }
 
-const tableName = "devices"
+const (
+	tableName        = "devices"
+	tagTableName     = "device_tags"
+	historyTableName = "dep_assignment_history"
+
+	// pushInfoTableName is the table of the apns push info store, which ResetEnrollment clears.
+	pushInfoTableName = "push_info"
+)
+
+// normalizeSerial returns the form serial numbers are stored in.
+// Apple serial numbers are case insensitive, so they are stored trimmed of spaces and in upper case.
+// It must agree with serialKey.
+func normalizeSerial(serial string) string {
+	return strings.ToUpper(strings.Trim(serial, " "))
+}
+
+// serialKey is normalizeSerial in SQL, the expression the devices_serial_number_key index
+// compares serial numbers with. btrim only trims spaces, like normalizeSerial.
+const serialKey = "upper(btrim(serial_number))"
 
+// Save inserts the device, or updates every column of the device with the same uuid.
+// Upserts that fail because of a serialization failure or deadlock with a concurrent save
+// are retried a few times, unless the store is scoped to a transaction.
 func (d *Postgres) Save(ctx context.Context, device *device.Device) error {
-	updateQuery, _, err := sq.StatementBuilder.PlaceholderFormat(sq.Dollar).
-		Update(tableName).
-		Prefix("ON CONFLICT (uuid) DO").
-		Set("uuid", device.UUID).
-		Set("udid", device.UDID).
-		Set("serial_number", device.SerialNumber).
-		Set("os_version", device.OSVersion).
-		Set("build_version", device.BuildVersion).
-		Set("product_name", device.ProductName).
-		Set("imei", device.IMEI).
-		Set("meid", device.MEID).
-		Set("push_magic", device.PushMagic).
-		Set("awaiting_configuration", device.AwaitingConfiguration).
-		Set("token", device.Token).
-		Set("unlock_token", device.UnlockToken).
-		Set("enrolled", device.Enrolled).
-		Set("description", device.Description).
-		Set("model", device.Model).
-		Set("model_name", device.ModelName).
-		Set("device_name", device.DeviceName).
-		Set("color", device.Color).
-		Set("asset_tag", device.AssetTag).
-		Set("dep_profile_status", device.DEPProfileStatus).
-		Set("dep_profile_uuid", device.DEPProfileUUID).
-		Set("dep_profile_assign_time", device.DEPProfileAssignTime).
-		Set("dep_profile_push_time", device.DEPProfilePushTime).
-		Set("dep_profile_assigned_date", device.DEPProfileAssignedDate).
-		Set("dep_profile_assigned_by", device.DEPProfileAssignedBy).
-		Set("last_seen", device.LastSeen).
-		ToSql()
-	if err != nil {
-		return errors.Wrap(err, "building update query for device save")
-	}
-	updateQuery = strings.Replace(updateQuery, tableName, "", -1)
-
-	query, args, err := sq.StatementBuilder.PlaceholderFormat(sq.Dollar).
-		Insert(tableName).
-		Columns(columns()...).
-		Values(
-			device.UUID,
-			device.UDID,
-			device.SerialNumber,
-			device.OSVersion,
-			device.BuildVersion,
-			device.ProductName,
-			device.IMEI,
-			device.MEID,
-			device.PushMagic,
-			device.AwaitingConfiguration,
-			device.Token,
-			device.UnlockToken,
-			device.Enrolled,
-			device.Description,
-			device.Model,
-			device.ModelName,
-			device.DeviceName,
-			device.Color,
-			device.AssetTag,
-			device.DEPProfileStatus,
-			device.DEPProfileUUID,
-			device.DEPProfileAssignTime,
-			device.DEPProfilePushTime,
-			device.DEPProfileAssignedDate,
-			device.DEPProfileAssignedBy,
-			device.LastSeen,
-		).
+	_, err := d.Upsert(ctx, device)
+	return err
+}
+
+// Upsert saves dev like Save, and reports whether the device was created
+// rather than updated in place.
+func (d *Postgres) Upsert(ctx context.Context, dev *device.Device) (bool, error) {
+	query, args, err := saveQuery(d.table, onUUID, dev)
+	if err != nil {
+		return false, err
+	}
+	// xmax is only set on a row version written by an update, so it is zero for an insert.
+	query += " RETURNING (xmax = 0)"
+
+	var created bool
+	exec := func() error {
+		return d.conn().GetContext(ctx, &created, query, args...)
+	}
+	if d.tx != nil {
+		// a failed statement aborts the transaction, so it cannot be retried on its own.
+		return created, errors.Wrap(uniqueConflict(exec(), dev), "exec device save in pg")
+	}
+	return created, errors.Wrap(uniqueConflict(withRetry(ctx, exec), dev), "exec device save in pg")
+}
+
+// SaveManualEnrollment saves a device which enrolled with an enrollment profile rather than DEP.
+// Such devices may not report a serial number, so instead of the uuid the upsert matches an
+// existing device on its udid, keeping that device's uuid. The uuid of the saved device is returned.
+func (d *Postgres) SaveManualEnrollment(ctx context.Context, dev *device.Device) (string, error) {
+	if dev.UDID == "" {
+		return "", invalid(errors.Errorf("manually enrolled device %s is missing a udid", dev.UUID))
+	}
+	query, args, err := saveQuery(d.table, onUDID, dev)
+	if err != nil {
+		return "", err
+	}
+	query += " RETURNING uuid"
+
+	var uuid string
+	exec := func() error {
+		return d.conn().GetContext(ctx, &uuid, query, args...)
+	}
+	if d.tx != nil {
+		return uuid, errors.Wrap(uniqueConflict(exec(), dev), "exec manual enrollment save in pg")
+	}
+	return uuid, errors.Wrap(uniqueConflict(withRetry(ctx, exec), dev), "exec manual enrollment save in pg")
+}
+
+// BulkSave saves all devices in a single transaction, with the same upsert semantics as Save.
+// If any device fails to save, none of the devices are saved.
+//
+// With WithBatchSize, each batch is saved in its own transaction instead, so the batches before
+// a failed one stay saved. The error names the failed batch and the number of devices saved before it.
+func (d *Postgres) BulkSave(ctx context.Context, devices []*device.Device) error {
+	// invalid devices are rejected before any batch is saved.
+	for _, dev := range devices {
+		if err := dev.Validate(); err != nil {
+			return invalid(errors.Wrap(err, "bulk save"))
+		}
+	}
+	if d.batchSize <= 0 || d.tx != nil {
+		return d.saveBatch(ctx, devices)
+	}
+	for start := 0; start < len(devices); start += d.batchSize {
+		end := start + d.batchSize
+		if end > len(devices) {
+			end = len(devices)
+		}
+		if err := d.saveBatch(ctx, devices[start:end]); err != nil {
+			return errors.Wrapf(err, "bulk save batch %d, after saving %d devices", start/d.batchSize+1, start)
+		}
+	}
+	return nil
+}
+
+func (d *Postgres) saveBatch(ctx context.Context, devices []*device.Device) error {
+	return d.WithTx(ctx, func(tx Store) error {
+		for _, dev := range devices {
+			if err := tx.Save(ctx, dev); err != nil {
+				return errors.Wrapf(err, "bulk save of device %s", dev.UUID)
+			}
+		}
+		return nil
+	})
+}
+
+// Conflict targets of the device upserts.
+const (
+	onUUID = "(uuid)"
+	// udids are only unique when set and not deleted, see the devices_udid_key index.
+	onUDID = "(udid) WHERE udid <> '' AND deleted_at IS NULL"
+)
+
+// saveQuery builds the upsert of device into table. When a device conflicting on target
+// exists, every column is updated from device except the conflict target itself and uuid.
+func saveQuery(table, target string, device *device.Device) (string, []interface{}, error) {
+	if err := device.Validate(); err != nil {
+		return "", nil, invalid(err)
+	}
+	cols, vals := columns(), values(device)
+	update := sq.StatementBuilder.PlaceholderFormat(sq.Dollar).
+		Update(table).
+		Prefix("ON CONFLICT " + target + " DO")
+	for _, col := range cols {
+		if col == "uuid" {
+			continue
+		}
+		update = update.Set(col, sq.Expr("EXCLUDED."+col))
+	}
+
+	// enrolled_at records when the device was first saved as enrolled,
+	// and is kept when the device checks in or re-enrolls.
+	var enrolledAt interface{}
+	if device.Enrolled {
+		enrolledAt = sq.Expr("now()")
+	}
+	cols, vals = append(cols, "enrolled_at"), append(vals, enrolledAt)
+	update = update.Set("enrolled_at", sq.Expr("COALESCE(devices.enrolled_at, CASE WHEN EXCLUDED.enrolled THEN now() END)"))
+
+	updateQuery, _, err := update.ToSql()
+	if err != nil {
+		return "", nil, errors.Wrap(err, "building update query for device save")
+	}
+	// Strip the table name following UPDATE, which ON CONFLICT does not accept.
+	updateQuery = strings.Replace(updateQuery, table, "", 1)
+
+	query, args, err := sq.StatementBuilder.PlaceholderFormat(sq.Dollar).
+		Insert(table).
+		Columns(cols...).
+		Values(vals...).
 		Suffix(updateQuery).
 		ToSql()
+	return query, args, errors.Wrap(err, "building device save query")
+}
+
+// UpdateDevice updates the device with the same uuid as dev.
+// Only the non-zero fields of dev are written, so UpdateDevice cannot be used
+// to clear a field or set a boolean to false. Setting Enrolled records enrolled_at like Save.
+func (d *Postgres) UpdateDevice(ctx context.Context, dev *device.Device) error {
+	stmt := sq.StatementBuilder.PlaceholderFormat(sq.Dollar).
+		Update(d.table).
+		Where(sq.Eq{"uuid": dev.UUID}).
+		Where(notDeleted)
+
+	if !hasFields(dev) {
+		return invalid(errors.Errorf("no fields to update for device %s", dev.UUID))
+	}
+	vals := values(dev)
+	for i, col := range columns() {
+		if col == "uuid" || isZero(vals[i]) {
+			continue
+		}
+		stmt = stmt.Set(col, vals[i])
+	}
+	if dev.Enrolled {
+		// like Save, keep the time the device was first enrolled.
+		stmt = stmt.Set("enrolled_at", sq.Expr("COALESCE(enrolled_at, now())"))
+	}
+
+	query, args, err := stmt.ToSql()
+	if err != nil {
+		return errors.Wrap(err, "building device update query")
+	}
+	n, err := d.execCount(ctx, "device update", query, args...)
+	if err != nil {
+		return uniqueConflict(err, dev)
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// AssignWorkflow assigns workflowUUID to every device in deviceUUIDs with a single statement.
+// Unknown or deleted device uuids are skipped rather than treated as an error;
+// the returned count is the number of devices that were updated.
+func (d *Postgres) AssignWorkflow(ctx context.Context, deviceUUIDs []string, workflowUUID string) (int, error) {
+	if len(deviceUUIDs) == 0 {
+		return 0, nil
+	}
+	query, args, err := sq.StatementBuilder.PlaceholderFormat(sq.Dollar).
+		Update(d.table).
+		Set("workflow_uuid", workflowUUID).
+		Where(sq.Eq{"uuid": deviceUUIDs}).
+		Where(notDeleted).
+		ToSql()
 	if err != nil {
-		return errors.Wrap(err, "building device save query")
+		return 0, errors.Wrap(err, "building sql")
 	}
+	return d.execCount(ctx, "assign workflow", query, args...)
+}
 
-	_, err = d.db.ExecContext(ctx, query, args...)
-	return errors.Wrap(err, "exec device save in pg")
+// RetargetWorkflow moves every device assigned the workflow oldUUID to the workflow newUUID with
+// a single statement, and returns the number of devices moved. Soft deleted devices are moved too,
+// so that no device refers to a retired workflow.
+func (d *Postgres) RetargetWorkflow(ctx context.Context, oldUUID, newUUID string) (int, error) {
+	query, args, err := sq.StatementBuilder.PlaceholderFormat(sq.Dollar).
+		Update(d.table).
+		Set("workflow_uuid", newUUID).
+		Where(sq.Eq{"workflow_uuid": oldUUID}).
+		ToSql()
+	if err != nil {
+		return 0, errors.Wrap(err, "building sql")
+	}
+	return d.execCount(ctx, "retarget workflow", query, args...)
 }
 
-func (d *Postgres) DeviceByUDID(ctx context.Context, udid string) (*device.Device, error) {
+// ClearDEPProfile resets the DEP profile uuid, status, assign time and push time of the device
+// with the given serial number to their column defaults, leaving the rest of the device unchanged.
+// The profile times have no default, so they are cleared to NULL.
+func (d *Postgres) ClearDEPProfile(ctx context.Context, serial string) error {
+	stmt := sq.StatementBuilder.PlaceholderFormat(sq.Dollar).
+		Update(d.table).
+		Where(sq.Eq{"serial_number": normalizeSerial(serial)}).
+		Where(notDeleted)
+	for _, col := range []string{
+		"dep_profile_uuid",
+		"dep_profile_status",
+		"dep_profile_assign_time",
+		"dep_profile_push_time",
+	} {
+		stmt = stmt.Set(col, sq.Expr("DEFAULT"))
+	}
+	query, args, err := stmt.ToSql()
+	if err != nil {
+		return errors.Wrap(err, "building sql")
+	}
+	n, err := d.execCount(ctx, "clear dep profile", query, args...)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// ResetEnrollment returns the device with the given serial number to its state before MDM enrollment,
+// for a device which was wiped and will enroll again. The udid, push token, push magic and unlock token
+// are cleared, the device is marked unenrolled and awaiting configuration, and its DEP profile, model,
+// color and asset tag are kept. The push info saved for its old udid, which holds the MDM topic, is deleted.
+// All of it happens in a single transaction.
+func (d *Postgres) ResetEnrollment(ctx context.Context, serial string) error {
+	return d.WithTx(ctx, func(tx Store) error {
+		return tx.(*Postgres).resetEnrollment(ctx, serial)
+	})
+}
+
+func (d *Postgres) resetEnrollment(ctx context.Context, serial string) error {
+	dev, err := d.deviceBy(ctx, "serial_number", normalizeSerial(serial))
+	if err != nil {
+		return err
+	}
+
+	query, args, err := sq.StatementBuilder.PlaceholderFormat(sq.Dollar).
+		Update(d.table).
+		Set("udid", sq.Expr("DEFAULT")).
+		Set("token", nil).
+		Set("push_magic", nil).
+		Set("unlock_token", nil).
+		Set("enrolled", false).
+		Set("awaiting_configuration", true).
+		Where(sq.Eq{"uuid": dev.UUID}).
+		ToSql()
+	if err != nil {
+		return errors.Wrap(err, "building sql")
+	}
+	if _, err := d.conn().ExecContext(ctx, query, args...); err != nil {
+		return errors.Wrap(err, "reset enrollment")
+	}
+
+	if dev.UDID == "" {
+		return nil
+	}
+	query, args, err = sq.StatementBuilder.PlaceholderFormat(sq.Dollar).
+		Delete(d.pushInfoTable).
+		Where(sq.Eq{"udid": dev.UDID}).
+		ToSql()
+	if err != nil {
+		return errors.Wrap(err, "building sql")
+	}
+	_, err = d.conn().ExecContext(ctx, query, args...)
+	return errors.Wrap(err, "delete push info of reset device")
+}
+
+// SetAwaitingConfiguration sets whether the device with the given udid is waiting at the
+// Setup Assistant configuration screen.
+func (d *Postgres) SetAwaitingConfiguration(ctx context.Context, udid string, awaiting bool) error {
+	query, args, err := sq.StatementBuilder.PlaceholderFormat(sq.Dollar).
+		Update(d.table).
+		Set("awaiting_configuration", awaiting).
+		Where(sq.Eq{"udid": udid}).
+		Where(notDeleted).
+		ToSql()
+	if err != nil {
+		return errors.Wrap(err, "building sql")
+	}
+	n, err := d.execCount(ctx, "set awaiting configuration", query, args...)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// RecordPush records that an APNs push was just sent to the device with the given udid.
+// A non-nil pushErr is stored as the last push error, and a nil pushErr clears it.
+// See the PushedBefore filter for finding devices due for another push.
+func (d *Postgres) RecordPush(ctx context.Context, udid string, pushErr error) error {
+	var lastErr string
+	if pushErr != nil {
+		lastErr = pushErr.Error()
+	}
 	query, args, err := sq.StatementBuilder.PlaceholderFormat(sq.Dollar).
-		Select(columns()...).
-		From(tableName).
+		Update(d.table).
+		Set("last_push_at", sq.Expr("now()")).
+		Set("last_push_error", lastErr).
 		Where(sq.Eq{"udid": udid}).
+		Where(notDeleted).
+		ToSql()
+	if err != nil {
+		return errors.Wrap(err, "building sql")
+	}
+	n, err := d.execCount(ctx, "record push", query, args...)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// DEPAssignment is an entry of the DEP profile assignment history of a device.
+type DEPAssignment struct {
+	DeviceUUID  string    `db:"device_uuid"`
+	ProfileUUID string    `db:"profile_uuid"`
+	AssignedAt  time.Time `db:"assigned_at"`
+	AssignedBy  string    `db:"assigned_by"`
+}
+
+// DEPAssignmentHistory returns every DEP profile the device with the given uuid was assigned, newest first.
+// An entry is recorded by the database whenever a device is saved with a DEP profile uuid different
+// from its previous one, and AssignedAt is the time it was saved.
+func (d *Postgres) DEPAssignmentHistory(ctx context.Context, deviceUUID string) ([]DEPAssignment, error) {
+	query, args, err := sq.StatementBuilder.PlaceholderFormat(sq.Dollar).
+		Select("device_uuid", "profile_uuid", "assigned_at", "assigned_by").
+		From(d.historyTable).
+		Where(sq.Eq{"device_uuid": deviceUUID}).
+		OrderBy("assigned_at DESC", "id DESC").
 		ToSql()
 	if err != nil {
 		return nil, errors.Wrap(err, "building sql")
 	}
+	var history []DEPAssignment
+	err = d.readConn().SelectContext(ctx, &history, query, args...)
+	return history, errors.Wrapf(err, "dep assignment history of device %s", deviceUUID)
+}
 
-	var dev device.Device
-	err = d.db.QueryRowxContext(ctx, query, args...).StructScan(&dev)
+// UpdateDEPStatusBySerials sets the DEP profile status of every device with one of the given serial numbers
+// in a single statement, and returns the number of devices updated.
+func (d *Postgres) UpdateDEPStatusBySerials(ctx context.Context, status device.DEPProfileStatus, serials []string) (int, error) {
+	if len(serials) == 0 {
+		return 0, nil
+	}
+	normalized := make([]string, len(serials))
+	for i, serial := range serials {
+		normalized[i] = normalizeSerial(serial)
+	}
+	query, args, err := sq.StatementBuilder.PlaceholderFormat(sq.Dollar).
+		Update(d.table).
+		Set("dep_profile_status", status).
+		Where("serial_number = ANY(?)", pq.Array(normalized)).
+		Where(notDeleted).
+		ToSql()
+	if err != nil {
+		return 0, errors.Wrap(err, "building sql")
+	}
+	return d.execCount(ctx, "update dep status by serials", query, args...)
+}
+
+// RecordDEPAssignResult records the outcome of a DEP profile assignment for the device with the given serial number.
+// Every call increments the attempt count. A non-nil assignErr is stored as the last error,
+// and a nil assignErr clears it, so the DEPAssignFailed filter only matches devices still needing a retry.
+func (d *Postgres) RecordDEPAssignResult(ctx context.Context, serial string, assignErr error) error {
+	var lastErr string
+	if assignErr != nil {
+		lastErr = assignErr.Error()
+	}
+	query, args, err := sq.StatementBuilder.PlaceholderFormat(sq.Dollar).
+		Update(d.table).
+		Set("dep_assign_error", lastErr).
+		Set("dep_assign_attempts", sq.Expr("dep_assign_attempts + 1")).
+		Where(sq.Eq{"serial_number": normalizeSerial(serial)}).
+		Where(notDeleted).
+		ToSql()
+	if err != nil {
+		return errors.Wrap(err, "building sql")
+	}
+	n, err := d.execCount(ctx, "record dep assign result", query, args...)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// deviceInformationColumns maps DeviceInformation query response keys to the device columns they update.
+var deviceInformationColumns = map[string]string{
+	"OSVersion":    "os_version",
+	"BuildVersion": "build_version",
+	"ProductName":  "product_name",
+	"ModelName":    "model_name",
+	"DeviceName":   "device_name",
+}
+
+// deviceInformationStorageColumns maps the DeviceInformation storage capacity keys to device columns.
+// Devices report capacity in base-10 gigabytes, which is stored as bytes.
+var deviceInformationStorageColumns = map[string]string{
+	"DeviceCapacity":          "total_storage",
+	"AvailableDeviceCapacity": "available_storage",
+}
+
+// UpdateFromDeviceInformation updates the device with the given udid from the QueryResponses
+// of a DeviceInformation command result.
+// Keys without a matching column, and values of an unexpected type, are ignored.
+func (d *Postgres) UpdateFromDeviceInformation(ctx context.Context, udid string, queryResponses map[string]interface{}) error {
+	stmt := sq.StatementBuilder.PlaceholderFormat(sq.Dollar).
+		Update(d.table).
+		Where(sq.Eq{"udid": udid}).
+		Where(notDeleted)
+
+	var changed bool
+	for key, value := range queryResponses {
+		if col, ok := deviceInformationColumns[key]; ok {
+			if s, ok := value.(string); ok {
+				stmt = stmt.Set(col, s)
+				changed = true
+			}
+		}
+		if col, ok := deviceInformationStorageColumns[key]; ok {
+			if gb, ok := value.(float64); ok {
+				stmt = stmt.Set(col, int64(gb*1e9))
+				changed = true
+			}
+		}
+	}
+	if !changed {
+		return nil
+	}
+
+	query, args, err := stmt.ToSql()
+	if err != nil {
+		return errors.Wrap(err, "building device information update query")
+	}
+	n, err := d.execCount(ctx, "device information update", query, args...)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// AddTags labels the device with the given uuid with each of tags.
+// Tags the device already has are skipped.
+func (d *Postgres) AddTags(ctx context.Context, deviceUUID string, tags ...string) error {
+	if len(tags) == 0 {
+		return nil
+	}
+	stmt := sq.StatementBuilder.PlaceholderFormat(sq.Dollar).
+		Insert(d.tagTable).
+		Columns("device_uuid", "tag").
+		Suffix("ON CONFLICT DO NOTHING")
+	for _, tag := range tags {
+		stmt = stmt.Values(deviceUUID, tag)
+	}
+	query, args, err := stmt.ToSql()
+	if err != nil {
+		return errors.Wrap(err, "building sql")
+	}
+	_, err = d.conn().ExecContext(ctx, query, args...)
+	return errors.Wrapf(err, "add tags to device %s", deviceUUID)
+}
+
+// RemoveTags removes each of tags from the device with the given uuid.
+// Tags the device does not have are ignored.
+func (d *Postgres) RemoveTags(ctx context.Context, deviceUUID string, tags ...string) error {
+	if len(tags) == 0 {
+		return nil
+	}
+	query, args, err := sq.StatementBuilder.PlaceholderFormat(sq.Dollar).
+		Delete(d.tagTable).
+		Where(sq.Eq{"device_uuid": deviceUUID, "tag": tags}).
+		ToSql()
+	if err != nil {
+		return errors.Wrap(err, "building sql")
+	}
+	_, err = d.conn().ExecContext(ctx, query, args...)
+	return errors.Wrapf(err, "remove tags from device %s", deviceUUID)
+}
+
+// SetAttribute sets the custom attribute key of the device with the given uuid to value,
+// encoded as JSON, replacing any previous value of key. Custom attributes are for the
+// ad-hoc properties of a device, like a department or cost center. See AttributeEquals.
+func (d *Postgres) SetAttribute(ctx context.Context, deviceUUID, key string, value interface{}) error {
+	if key == "" {
+		return invalid(errors.Errorf("empty custom attribute key for device %s", deviceUUID))
+	}
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return invalid(errors.Wrapf(err, "encode custom attribute %s", key))
+	}
+	query, args, err := sq.StatementBuilder.PlaceholderFormat(sq.Dollar).
+		Update(d.table).
+		Set("custom_attributes", sq.Expr("custom_attributes || jsonb_build_object(?::text, ?::jsonb)", key, string(encoded))).
+		Where(sq.Eq{"uuid": deviceUUID}).
+		Where(notDeleted).
+		ToSql()
+	if err != nil {
+		return errors.Wrap(err, "building sql")
+	}
+	n, err := d.execCount(ctx, "set custom attribute", query, args...)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// GetAttributes returns the custom attributes of the device with the given uuid, decoded from JSON
+// like encoding/json decodes into an interface{}: numbers are returned as float64.
+// A device without custom attributes returns an empty map.
+func (d *Postgres) GetAttributes(ctx context.Context, deviceUUID string) (map[string]interface{}, error) {
+	query, args, err := sq.StatementBuilder.PlaceholderFormat(sq.Dollar).
+		Select("custom_attributes").
+		From(d.table).
+		Where(sq.Eq{"uuid": deviceUUID}).
+		Where(notDeleted).
+		ToSql()
+	if err != nil {
+		return nil, errors.Wrap(err, "building sql")
+	}
+	var encoded []byte
+	err = d.readConn().GetContext(ctx, &encoded, query, args...)
 	if errors.Cause(err) == sql.ErrNoRows {
-		return nil, deviceNotFoundErr{}
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "get custom attributes of device %s", deviceUUID)
+	}
+	attributes := make(map[string]interface{})
+	err = json.Unmarshal(encoded, &attributes)
+	return attributes, errors.Wrapf(err, "decode custom attributes of device %s", deviceUUID)
+}
+
+// execCount executes query and returns the number of rows it affected.
+func (d *Postgres) execCount(ctx context.Context, op, query string, args ...interface{}) (int, error) {
+	result, err := d.conn().ExecContext(ctx, query, args...)
+	if err != nil {
+		return 0, errors.Wrapf(err, "exec %s in pg", op)
 	}
-	return &dev, errors.Wrap(err, "finding device by udid")
+	n, err := result.RowsAffected()
+	return int(n), errors.Wrapf(err, "rows affected by %s", op)
+}
+
+func isZero(v interface{}) bool {
+	switch v := v.(type) {
+	case string:
+		return v == ""
+	case device.DEPProfileStatus:
+		return v == ""
+	case bool:
+		return !v
+	case int64:
+		return v == 0
+	case time.Time:
+		return v.IsZero()
+	default:
+		return v == nil
+	}
+}
+
+func (d *Postgres) DeviceByUDID(ctx context.Context, udid string) (*device.Device, error) {
+	return d.deviceBy(ctx, "udid", udid)
 }
 
 func (d *Postgres) DeviceBySerial(ctx context.Context, serial string) (*device.Device, error) {
+	return d.deviceBy(ctx, "serial_number", normalizeSerial(serial))
+}
+
+// DeviceByIMEI returns the device with the given IMEI, or ErrNotFound.
+// Devices without a cellular modem have an empty IMEI, so an empty imei never matches.
+func (d *Postgres) DeviceByIMEI(ctx context.Context, imei string) (*device.Device, error) {
+	if imei == "" {
+		return nil, ErrNotFound
+	}
+	return d.deviceBy(ctx, "imei", imei)
+}
+
+// DeviceByMEID returns the device with the given MEID, or ErrNotFound.
+// An empty meid never matches.
+func (d *Postgres) DeviceByMEID(ctx context.Context, meid string) (*device.Device, error) {
+	if meid == "" {
+		return nil, ErrNotFound
+	}
+	return d.deviceBy(ctx, "meid", meid)
+}
+
+// DeviceByPushToken returns the device with the given APNs push token, or ErrNotFound.
+// It is used to find the device for a token APNs reports as invalid. An empty token never matches.
+func (d *Postgres) DeviceByPushToken(ctx context.Context, token string) (*device.Device, error) {
+	if token == "" {
+		return nil, ErrNotFound
+	}
+	return d.deviceBy(ctx, "token", token)
+}
+
+// DeviceByAssetTag returns the device with the given asset tag, or ErrNotFound.
+// Asset tags are unique, and an empty tag never matches.
+func (d *Postgres) DeviceByAssetTag(ctx context.Context, tag string) (*device.Device, error) {
+	if tag == "" {
+		return nil, ErrNotFound
+	}
+	return d.deviceBy(ctx, "asset_tag", tag)
+}
+
+// deviceBy returns the device whose col equals value, or ErrNotFound.
+func (d *Postgres) deviceBy(ctx context.Context, col, value string) (*device.Device, error) {
 	query, args, err := sq.StatementBuilder.PlaceholderFormat(sq.Dollar).
-		Select(columns()...).
-		From(tableName).
-		Where(sq.Eq{"serial_number": serial}).
+		Select(selectColumns()...).
+		From(d.table).
+		Where(sq.Eq{col: value}).
+		Where(notDeleted).
 		ToSql()
 	if err != nil {
 		return nil, errors.Wrap(err, "building sql")
 	}
 
 	var dev device.Device
-	err = d.db.QueryRowxContext(ctx, query, args...).StructScan(&dev)
+	err = d.readConn().GetContext(ctx, &dev, query, args...)
 	if errors.Cause(err) == sql.ErrNoRows {
-		return nil, deviceNotFoundErr{}
+		return nil, ErrNotFound
 	}
-	return &dev, errors.Wrap(err, "finding device by serial")
+	return &dev, errors.Wrapf(err, "finding device by %s", col)
+}
+
+// MergeDevices merges the device with uuid mergeUUID into the device with uuid keepUUID, for a device
+// which was saved twice, for example after enrolling again with a new udid. The non-empty fields of the
+// merged device overwrite those of the kept device, the workflow of the merged device is assigned if the
+// kept device has none, and the tags and DEP assignment history of both are kept.
+// The merged device is then deleted. All of it happens in a single transaction.
+func (d *Postgres) MergeDevices(ctx context.Context, keepUUID, mergeUUID string) error {
+	if keepUUID == mergeUUID {
+		return invalid(errors.Errorf("cannot merge device %s into itself", keepUUID))
+	}
+	return d.WithTx(ctx, func(tx Store) error {
+		return tx.(*Postgres).mergeDevices(ctx, keepUUID, mergeUUID)
+	})
+}
+
+func (d *Postgres) mergeDevices(ctx context.Context, keepUUID, mergeUUID string) error {
+	if _, err := d.deviceBy(ctx, "uuid", keepUUID); err != nil {
+		return errors.Wrap(err, "find device to keep")
+	}
+	merged, err := d.deviceBy(ctx, "uuid", mergeUUID)
+	if err != nil {
+		return errors.Wrap(err, "find device to merge")
+	}
+
+	statements := []struct {
+		op    string
+		query string
+		args  []interface{}
+	}{
+		{
+			op: "merge workflow",
+			query: `UPDATE ` + d.table + ` SET workflow_uuid = (SELECT workflow_uuid FROM ` + d.table + ` WHERE uuid = $2)
+				WHERE uuid = $1 AND COALESCE(workflow_uuid, '') = ''`,
+			args: []interface{}{keepUUID, mergeUUID},
+		},
+		{
+			op: "merge tags",
+			query: `INSERT INTO ` + d.tagTable + ` (device_uuid, tag)
+				SELECT $1, tag FROM ` + d.tagTable + ` WHERE device_uuid = $2 ON CONFLICT DO NOTHING`,
+			args: []interface{}{keepUUID, mergeUUID},
+		},
+		{
+			op:    "merge dep assignment history",
+			query: `UPDATE ` + d.historyTable + ` SET device_uuid = $1 WHERE device_uuid = $2`,
+			args:  []interface{}{keepUUID, mergeUUID},
+		},
+		{
+			// deleted before the update, which could otherwise conflict on the udid or asset tag of the merged device.
+			op:    "delete merged device",
+			query: `DELETE FROM ` + d.table + ` WHERE uuid = $1`,
+			args:  []interface{}{mergeUUID},
+		},
+	}
+	for _, stmt := range statements {
+		if _, err := d.conn().ExecContext(ctx, stmt.query, stmt.args...); err != nil {
+			return errors.Wrapf(err, "%s %s into %s", stmt.op, mergeUUID, keepUUID)
+		}
+	}
+
+	merged.UUID = keepUUID
+	if !hasFields(merged) {
+		// nothing to copy, and UpdateDevice rejects an update without fields.
+		return nil
+	}
+	return errors.Wrapf(d.UpdateDevice(ctx, merged), "merge fields of device %s into %s", mergeUUID, keepUUID)
+}
+
+// hasFields reports whether dev has a non-empty field besides its uuid, which UpdateDevice would write.
+func hasFields(dev *device.Device) bool {
+	vals := values(dev)
+	for i, col := range columns() {
+		if col != "uuid" && !isZero(vals[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+// DeviceExists reports whether a device with the given serial number exists, without fetching it.
+// Soft deleted devices are reported as not existing.
+func (d *Postgres) DeviceExists(ctx context.Context, serial string) (bool, error) {
+	query, args, err := sq.StatementBuilder.PlaceholderFormat(sq.Dollar).
+		Select("1").
+		Prefix("SELECT EXISTS(").
+		From(d.table).
+		Where(sq.Eq{"serial_number": normalizeSerial(serial)}).
+		Where(notDeleted).
+		Suffix(")").
+		ToSql()
+	if err != nil {
+		return false, errors.Wrap(err, "building sql")
+	}
+	var exists bool
+	err = d.readConn().GetContext(ctx, &exists, query, args...)
+	return exists, errors.Wrap(err, "checking device exists by serial")
 }
 
 func (d *Postgres) ListDevices(ctx context.Context, opt device.ListDevicesOption) ([]device.Device, error) {
 	query, args, err := sq.StatementBuilder.PlaceholderFormat(sq.Dollar).
-		Select(columns()...).
-		From(tableName).
+		Select(selectColumns()...).
+		From(d.table).
+		Where(notDeleted).
 		ToSql()
 	if err != nil {
 		return nil, errors.Wrap(err, "building sql")
 	}
 	var list []device.Device
-	err = d.db.SelectContext(ctx, &list, query, args...)
+	err = d.readConn().SelectContext(ctx, &list, query, args...)
 	return list, errors.Wrap(err, "list devices")
 }
 
+// Devices returns the devices matching all of the provided filters.
+// Filters are squirrel Sqlizers, so their values are always bound as query arguments,
+// and can be grouped with sq.Or and sq.And, or negated with Not:
+//
+//	d.Devices(ctx, sq.Or{ModelLike{"iPhone%"}, ModelLike{"iPad%"}})
+//	d.Devices(ctx, Not{DEPProfileStatus{device.ASSIGNED}})
+//
+// Limit, Offset and OrderBy may also be passed to page through the results.
+// Soft deleted devices are excluded unless IncludeDeleted is passed.
+func (d *Postgres) Devices(ctx context.Context, params ...interface{}) ([]device.Device, error) {
+	rows, err := d.DevicesIter(ctx, params...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []device.Device
+	for rows.Next() {
+		list = append(list, rows.Device())
+	}
+	return list, errors.Wrap(rows.Err(), "select devices")
+}
+
+// DevicesAfter returns up to limit devices with a uuid greater than afterUUID, ordered by uuid.
+// Passing the uuid of the last device of a page returns the next page, and an empty afterUUID
+// returns the first page. Unlike Offset, the cost of a page does not grow with its position.
+func (d *Postgres) DevicesAfter(ctx context.Context, afterUUID string, limit int) ([]device.Device, error) {
+	params := []interface{}{OrderBy{Column: "uuid"}, Limit{N: limit}}
+	if afterUUID != "" {
+		params = append(params, sq.Gt{"uuid": afterUUID})
+	}
+	return d.Devices(ctx, params...)
+}
+
+// DevicesIter is like Devices, but returns a cursor which scans the devices one at a time.
+// A statement timeout set with WithStatementTimeout applies until the cursor is closed.
+func (d *Postgres) DevicesIter(ctx context.Context, params ...interface{}) (*DeviceRows, error) {
+	stmt, err := selectDevices(d.table, d.tagTable, params...)
+	if err != nil {
+		return nil, err
+	}
+	query, args, err := stmt.ToSql()
+	if err != nil {
+		return nil, errors.Wrap(err, "building sql")
+	}
+	// the statement timeout covers the whole iteration, until the rows are closed.
+	ctx, cancel := d.withTimeout(ctx)
+	rows, err := d.readConn().QueryxContext(ctx, query, args...)
+	if err != nil {
+		cancel()
+		return nil, d.timeoutErr(ctx, errors.Wrap(err, "select devices"))
+	}
+	return &DeviceRows{rows: rows, ctx: ctx, cancel: cancel, timeout: d.timeout}, nil
+}
+
+// CountDevices returns the number of devices matching the provided filters.
+// It accepts the same parameters as Devices, ignoring ordering and paging.
+func (d *Postgres) CountDevices(ctx context.Context, params ...interface{}) (int, error) {
+	stmt, err := countDevices(d.table, d.tagTable, params...)
+	if err != nil {
+		return 0, err
+	}
+	query, args, err := stmt.ToSql()
+	if err != nil {
+		return 0, errors.Wrap(err, "building sql")
+	}
+	var count int
+	err = d.readConn().GetContext(ctx, &count, query, args...)
+	return count, errors.Wrap(err, "count devices")
+}
+
+// CountByModel returns the number of devices of each model.
+// Devices without a model are counted under the empty string.
+func (d *Postgres) CountByModel(ctx context.Context) (map[string]int, error) {
+	query, args, err := sq.StatementBuilder.PlaceholderFormat(sq.Dollar).
+		Select("COALESCE(model, '') AS model", "COUNT(*) AS count").
+		From(d.table).
+		Where(notDeleted).
+		GroupBy("COALESCE(model, '')").
+		ToSql()
+	if err != nil {
+		return nil, errors.Wrap(err, "building sql")
+	}
+	var rows []struct {
+		Model string `db:"model"`
+		Count int    `db:"count"`
+	}
+	if err := d.readConn().SelectContext(ctx, &rows, query, args...); err != nil {
+		return nil, errors.Wrap(err, "count devices by model")
+	}
+
+	counts := make(map[string]int, len(rows))
+	for _, row := range rows {
+		counts[row.Model] = row.Count
+	}
+	return counts, nil
+}
+
+// DEPAssignmentsByDay returns the number of devices assigned a DEP profile on each day since the
+// given time, keyed by the YYYY-MM-DD date of dep_profile_assigned_date. Days without assignments
+// are omitted, and devices without an assigned date are not counted.
+func (d *Postgres) DEPAssignmentsByDay(ctx context.Context, since time.Time) (map[string]int, error) {
+	query, args, err := sq.StatementBuilder.PlaceholderFormat(sq.Dollar).
+		Select("to_char(dep_profile_assigned_date, 'YYYY-MM-DD') AS day", "COUNT(*) AS count").
+		From(d.table).
+		Where(sq.GtOrEq{"dep_profile_assigned_date": since}).
+		Where(notDeleted).
+		GroupBy("day").
+		ToSql()
+	if err != nil {
+		return nil, errors.Wrap(err, "building sql")
+	}
+	var rows []struct {
+		Day   string `db:"day"`
+		Count int    `db:"count"`
+	}
+	if err := d.readConn().SelectContext(ctx, &rows, query, args...); err != nil {
+		return nil, errors.Wrap(err, "count dep assignments by day")
+	}
+
+	counts := make(map[string]int, len(rows))
+	for _, row := range rows {
+		counts[row.Day] = row.Count
+	}
+	return counts, nil
+}
+
+// distinctColumns are the text columns DistinctValues can be called with.
+var distinctColumns = map[string]bool{
+	"model":              true,
+	"model_name":         true,
+	"product_name":       true,
+	"color":              true,
+	"os_version":         true,
+	"build_version":      true,
+	"dep_profile_status": true,
+	"dep_profile_uuid":   true,
+}
+
+// FindDuplicateSerials returns the normalized serial numbers shared by more than one device,
+// mapped to the sorted uuids of those devices. Serial numbers saved before they were normalized
+// may only differ in case or whitespace.
+func (d *Postgres) FindDuplicateSerials(ctx context.Context) (map[string][]string, error) {
+	query, args, err := sq.StatementBuilder.PlaceholderFormat(sq.Dollar).
+		Select(serialKey+" AS serial", "array_agg(uuid ORDER BY uuid) AS uuids").
+		From(d.table).
+		Where("serial_number <> ''").
+		Where(notDeleted).
+		GroupBy(serialKey).
+		Having("COUNT(*) > 1").
+		ToSql()
+	if err != nil {
+		return nil, errors.Wrap(err, "building sql")
+	}
+	var rows []struct {
+		Serial string         `db:"serial"`
+		UUIDs  pq.StringArray `db:"uuids"`
+	}
+	if err := d.readConn().SelectContext(ctx, &rows, query, args...); err != nil {
+		return nil, errors.Wrap(err, "find duplicate serials")
+	}
+
+	duplicates := make(map[string][]string, len(rows))
+	for _, row := range rows {
+		duplicates[row.Serial] = row.UUIDs
+	}
+	return duplicates, nil
+}
+
+// DistinctValues returns the sorted set of values of column across all devices, skipping NULLs.
+// column must be one of the columns allowed for DistinctValues.
+func (d *Postgres) DistinctValues(ctx context.Context, column string) ([]string, error) {
+	if !distinctColumns[column] {
+		return nil, errors.Errorf("cannot list distinct values of device column %q", column)
+	}
+	query, args, err := sq.StatementBuilder.PlaceholderFormat(sq.Dollar).
+		Select(column).
+		Distinct().
+		From(d.table).
+		Where(sq.NotEq{column: nil}).
+		Where(notDeleted).
+		OrderBy("1").
+		ToSql()
+	if err != nil {
+		return nil, errors.Wrap(err, "building sql")
+	}
+	var values []string
+	err = d.readConn().SelectContext(ctx, &values, query, args...)
+	return values, errors.Wrapf(err, "select distinct device %s", column)
+}
+
+// Search returns up to limit devices whose serial number, model or description contains term, ignoring case.
+// LIKE wildcards in term are matched literally.
+func (d *Postgres) Search(ctx context.Context, term string, limit int) ([]device.Device, error) {
+	pattern := "%" + escapeLike(term) + "%"
+	return d.Devices(ctx, sq.Or{
+		sq.Expr("serial_number ILIKE ?", pattern),
+		sq.Expr("model ILIKE ?", pattern),
+		sq.Expr("description ILIKE ?", pattern),
+	}, Limit{N: limit})
+}
+
+// DevicesByDEPProfile returns the devices assigned a DEP profile, grouped by the profile uuid.
+// Devices without a DEP profile are skipped. The rows are scanned one at a time with DevicesIter,
+// so only the returned devices are held in memory.
+func (d *Postgres) DevicesByDEPProfile(ctx context.Context) (map[string][]device.Device, error) {
+	rows, err := d.DevicesIter(ctx, sq.Expr("COALESCE(dep_profile_uuid, '') <> ''"))
+	if err != nil {
+		return nil, errors.Wrap(err, "query devices by dep profile")
+	}
+	defer rows.Close()
+
+	byProfile := make(map[string][]device.Device)
+	for rows.Next() {
+		dev := rows.Device()
+		byProfile[dev.DEPProfileUUID] = append(byProfile[dev.DEPProfileUUID], dev)
+	}
+	return byProfile, errors.Wrap(rows.Err(), "group devices by dep profile")
+}
+
+// ExportDevices writes every device that is not soft deleted to w as newline delimited JSON, one device per line.
+// Rows are streamed from the database, so the table is never held in memory.
+func (d *Postgres) ExportDevices(ctx context.Context, w io.Writer) error {
+	rows, err := d.DevicesIter(ctx)
+	if err != nil {
+		return errors.Wrap(err, "query devices for export")
+	}
+	defer rows.Close()
+
+	enc := json.NewEncoder(w)
+	for rows.Next() {
+		dev := rows.Device()
+		if err := enc.Encode(dev.WithSecrets()); err != nil {
+			return errors.Wrapf(err, "encode device %s", dev.UUID)
+		}
+	}
+	return errors.Wrap(rows.Err(), "export devices")
+}
+
+// ImportDevices saves each device read from r, in the format written by ExportDevices,
+// and returns the number of devices saved.
+// Existing devices are updated as with Save. Import stops at the first device that fails to decode or save.
+func (d *Postgres) ImportDevices(ctx context.Context, r io.Reader) (int, error) {
+	dec := json.NewDecoder(r)
+	var n int
+	for {
+		var dev device.Device
+		err := dec.Decode(&dev)
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return n, errors.Wrapf(err, "decode device %d of import", n+1)
+		}
+		if err := d.Save(ctx, &dev); err != nil {
+			return n, errors.Wrapf(err, "import device %s", dev.UUID)
+		}
+		n++
+	}
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+// escapeLike escapes the LIKE wildcards in s, using the default backslash escape character.
+func escapeLike(s string) string {
+	return likeEscaper.Replace(s)
+}
+
+// PushableDevices returns the enrolled devices which have a push token and push magic,
+// and can therefore be sent a push notification.
+func (d *Postgres) PushableDevices(ctx context.Context) ([]device.Device, error) {
+	return d.Devices(ctx, pushable)
+}
+
+var pushable = sq.And{
+	Enrolled{Enrolled: true},
+	sq.NotEq{"token": ""},
+	sq.NotEq{"push_magic": ""},
+}
+
+// ClaimDevicesForPush claims up to limit pushable devices for a push batch, choosing the devices
+// claimed least recently, and records the claim time. Rows locked by a concurrent claim are skipped,
+// so concurrent workers always receive disjoint sets of devices.
+func (d *Postgres) ClaimDevicesForPush(ctx context.Context, limit int) ([]device.Device, error) {
+	if limit <= 0 {
+		return nil, nil
+	}
+	claim, claimArgs, err := sq.Select("uuid").
+		From(d.table).
+		Where(pushable).
+		Where(notDeleted).
+		OrderBy("push_claimed_at NULLS FIRST", "uuid").
+		Limit(uint64(limit)).
+		Suffix("FOR UPDATE SKIP LOCKED").
+		ToSql()
+	if err != nil {
+		return nil, errors.Wrap(err, "building sql")
+	}
+	query, args, err := sq.StatementBuilder.PlaceholderFormat(sq.Dollar).
+		Update(d.table).
+		Set("push_claimed_at", sq.Expr("now()")).
+		Where("uuid IN ("+claim+")", claimArgs...).
+		Suffix("RETURNING " + strings.Join(selectColumns(), ", ")).
+		ToSql()
+	if err != nil {
+		return nil, errors.Wrap(err, "building sql")
+	}
+	var claimed []device.Device
+	err = d.conn().SelectContext(ctx, &claimed, query, args...)
+	return claimed, errors.Wrap(err, "claim devices for push")
+}
+
+// DeleteDevice soft deletes the device with the given uuid by setting its deleted_at timestamp.
+// The row is kept for auditing, but is no longer returned by lookups.
+func (d *Postgres) DeleteDevice(ctx context.Context, uuid string) error {
+	query, args, err := sq.StatementBuilder.PlaceholderFormat(sq.Dollar).
+		Update(d.table).
+		Set("deleted_at", sq.Expr("now()")).
+		Where(sq.Eq{"uuid": uuid}).
+		Where(notDeleted).
+		ToSql()
+	if err != nil {
+		return errors.Wrap(err, "building sql")
+	}
+	n, err := d.execCount(ctx, "soft delete device by uuid", query, args...)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// ReapUnenrolled soft deletes the devices which were assigned a DEP profile before olderThan,
+// but never enrolled, and returns the number of devices deleted.
+// Devices which are or ever were enrolled, and devices which never had a DEP profile assigned, are not touched.
+func (d *Postgres) ReapUnenrolled(ctx context.Context, olderThan time.Time) (int, error) {
+	query, args, err := sq.StatementBuilder.PlaceholderFormat(sq.Dollar).
+		Update(d.table).
+		Set("deleted_at", sq.Expr("now()")).
+		Where("enrolled IS NOT TRUE").
+		// devices which enrolled and later checked out, for example for a repair, are kept.
+		Where("enrolled_at IS NULL").
+		// devices without a DEP assignment have a NULL assigned date, which is never less than olderThan.
+		Where(sq.Lt{"dep_profile_assigned_date": olderThan}).
+		Where(notDeleted).
+		ToSql()
+	if err != nil {
+		return 0, errors.Wrap(err, "building sql")
+	}
+	return d.execCount(ctx, "reap unenrolled devices", query, args...)
+}
+
 func (d *Postgres) DeleteByUDID(ctx context.Context, udid string) error {
 	query, args, err := sq.StatementBuilder.PlaceholderFormat(sq.Dollar).
-		Delete(tableName).
+		Delete(d.table).
 		Where(sq.Eq{"udid": udid}).
 		ToSql()
 	if err != nil {
 		return errors.Wrap(err, "building sql")
 	}
-	_, err = d.db.ExecContext(ctx, query, args...)
+	_, err = d.conn().ExecContext(ctx, query, args...)
 	return errors.Wrap(err, "delete device by udid")
 }
 
 func (d *Postgres) DeleteBySerial(ctx context.Context, serial string) error {
 	query, args, err := sq.StatementBuilder.PlaceholderFormat(sq.Dollar).
-		Delete(tableName).
-		Where(sq.Eq{"serial_number": serial}).
+		Delete(d.table).
+		Where(sq.Eq{"serial_number": normalizeSerial(serial)}).
 		ToSql()
 	if err != nil {
 		return errors.Wrap(err, "building sql")
 	}
-	_, err = d.db.ExecContext(ctx, query, args...)
+	_, err = d.conn().ExecContext(ctx, query, args...)
 	return errors.Wrap(err, "delete device by serial_number")
 }
 
+// uniqueConflict marks err as an ErrConflict if it is a unique violation, describing
+// the violations by dev of the unique asset tag and serial number indexes.
+// Any other error is returned unchanged.
+func uniqueConflict(err error, dev *device.Device) error {
+	pqErr, ok := errors.Cause(err).(*pq.Error)
+	if !ok || pqErr.Code != "23505" {
+		return err
+	}
+	switch pqErr.Constraint {
+	case "devices_asset_tag_key":
+		err = errors.Errorf("asset tag %q of device %s is already assigned to another device", dev.AssetTag, dev.UUID)
+	case "devices_serial_number_key":
+		err = errors.Errorf("serial number %q of device %s is already saved for another device", dev.SerialNumber, dev.UUID)
+	case "devices_udid_key":
+		err = errors.Errorf("udid %q of device %s is already saved for another device", dev.UDID, dev.UUID)
+	}
+	return kindErr{kind: ErrConflict, err: err}
+}
+
+// invalid marks err as an ErrValidation.
+func invalid(err error) error {
+	return kindErr{kind: ErrValidation, err: err}
+}
+
+// ErrNotFound is returned when a device lookup matches no rows.
+// It can be matched with errors.Is, and also satisfies the NotFound() behavior
+// checked by the device worker.
+var ErrNotFound error = deviceNotFoundErr{}
+
 type deviceNotFoundErr struct{}
 
 func (e deviceNotFoundErr) Error() string {
@@ -210,3 +1558,28 @@ func (e deviceNotFoundErr) Error() string {
 func (e deviceNotFoundErr) NotFound() bool {
 	return true
 }
+
+// Errors matched with errors.Is by the errors of writes which failed because the device
+// conflicts with another device on a unique column, or is invalid.
+var (
+	ErrConflict   = errors.New("device conflicts with an existing device")
+	ErrValidation = errors.New("invalid device")
+)
+
+// kindErr is an error which matches kind with errors.Is, and keeps the message of err.
+type kindErr struct {
+	kind error
+	err  error
+}
+
+func (e kindErr) Error() string {
+	return e.err.Error()
+}
+
+func (e kindErr) Unwrap() error {
+	return e.err
+}
+
+func (e kindErr) Is(target error) bool {
+	return target == e.kind
+}
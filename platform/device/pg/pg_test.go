@@ -1,13 +1,22 @@
 package pg
 
 import (
+	"bytes"
 	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/go-kit/kit/log"
+	"github.com/jmoiron/sqlx"
 	"github.com/kolide/kit/dbutil"
 	_ "github.com/lib/pq"
+	"github.com/pkg/errors"
+	sq "gopkg.in/Masterminds/squirrel.v1"
+
 	"github.com/micromdm/micromdm/platform/device"
 )
 
@@ -58,16 +67,3275 @@ func TestPGCrud(t *testing.T) {
 	}
 }
 
-func setup(t *testing.T) *Postgres {
-	db, err := dbutil.OpenDBX(
-		"postgres",
-		"host=localhost port=5432 user=micromdm dbname=micromdm_test password=micromdm sslmode=disable",
-		dbutil.WithLogger(log.NewNopLogger()),
-		dbutil.WithMaxAttempts(1),
-	)
+func TestUpsertCreated(t *testing.T) {
+	db := setup(t)
+	ctx := context.Background()
+	resetDevices(t, db)
+	defer resetDevices(t, db)
+
+	dev := device.Device{UUID: "upsert", SerialNumber: "C02UPSERT"}
+	created, err := db.Upsert(ctx, &dev)
 	if err != nil {
 		t.Fatal(err)
 	}
+	if !created {
+		t.Error("first upsert: have created false, want true")
+	}
 
-	return New(db)
+	dev.Model = "iPad8,1"
+	created, err = db.Upsert(ctx, &dev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created {
+		t.Error("conflicting upsert: have created true, want false")
+	}
+}
+
+func TestCreatedAtUpdatedAt(t *testing.T) {
+	db := setup(t)
+	ctx := context.Background()
+	resetDevices(t, db)
+	defer resetDevices(t, db)
+
+	dev := device.Device{UUID: "timestamps", UDID: "UDID-timestamps"}
+	if err := db.Save(ctx, &dev); err != nil {
+		t.Fatal(err)
+	}
+	first, err := db.DeviceByUDID(ctx, dev.UDID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.CreatedAt.IsZero() || first.UpdatedAt.IsZero() {
+		t.Fatalf("timestamps not set: created %v, updated %v", first.CreatedAt, first.UpdatedAt)
+	}
+
+	// now() is the start of the transaction, so the second write needs a later one.
+	time.Sleep(10 * time.Millisecond)
+	dev.Model = "iPhone10,3"
+	if err := db.Save(ctx, &dev); err != nil {
+		t.Fatal(err)
+	}
+	second, err := db.DeviceByUDID(ctx, dev.UDID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !second.CreatedAt.Equal(first.CreatedAt) {
+		t.Errorf("created_at changed from %v to %v", first.CreatedAt, second.CreatedAt)
+	}
+	if !second.UpdatedAt.After(first.UpdatedAt) {
+		t.Errorf("updated_at did not advance: first %v, second %v", first.UpdatedAt, second.UpdatedAt)
+	}
+
+	modified, err := db.Devices(ctx, ModifiedSince{Time: second.UpdatedAt})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := len(modified), 1; have != want {
+		t.Errorf("modified since the second write: have %d devices, want %d", have, want)
+	}
+	modified, err = db.Devices(ctx, ModifiedSince{Time: second.UpdatedAt.Add(time.Second)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := len(modified), 0; have != want {
+		t.Errorf("modified after the second write: have %d devices, want %d", have, want)
+	}
+}
+
+func TestModifiedSinceIgnoresPushes(t *testing.T) {
+	db := setup(t)
+	ctx := context.Background()
+	resetDevices(t, db)
+	defer resetDevices(t, db)
+
+	dev := device.Device{UUID: "pushed", UDID: "UDID-pushed", Enrolled: true, Token: "token", PushMagic: "magic"}
+	if err := db.Save(ctx, &dev); err != nil {
+		t.Fatal(err)
+	}
+	saved, err := db.DeviceByUDID(ctx, dev.UDID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// now() is the start of the transaction, so the push bookkeeping needs a later one.
+	time.Sleep(10 * time.Millisecond)
+	if err := db.RecordPush(ctx, dev.UDID, errors.New("bad device token")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.ClaimDevicesForPush(ctx, 10); err != nil {
+		t.Fatal(err)
+	}
+
+	pushed, err := db.DeviceByUDID(ctx, dev.UDID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !pushed.UpdatedAt.Equal(saved.UpdatedAt) {
+		t.Errorf("push bookkeeping changed updated_at from %v to %v", saved.UpdatedAt, pushed.UpdatedAt)
+	}
+	modified, err := db.Devices(ctx, ModifiedSince{Time: saved.UpdatedAt.Add(time.Millisecond)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := len(modified), 0; have != want {
+		t.Errorf("modified since the save: have %d devices, want %d", have, want)
+	}
+
+	// other changes still count.
+	dev.Model = "iPhone10,3"
+	if err := db.Save(ctx, &dev); err != nil {
+		t.Fatal(err)
+	}
+	modified, err = db.Devices(ctx, ModifiedSince{Time: saved.UpdatedAt.Add(time.Millisecond)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := len(modified), 1; have != want {
+		t.Errorf("modified since the model change: have %d devices, want %d", have, want)
+	}
+}
+
+func TestSaveManualEnrollment(t *testing.T) {
+	db := setup(t)
+	ctx := context.Background()
+	resetDevices(t, db)
+	defer resetDevices(t, db)
+
+	uuid, err := db.SaveManualEnrollment(ctx, &device.Device{UUID: "manual-1", UDID: "UDID-manual-1", Enrolled: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := uuid, "manual-1"; have != want {
+		t.Errorf("first enrollment: have uuid %s, want %s", have, want)
+	}
+
+	// a second device without a serial number must not collide with the first.
+	if _, err := db.SaveManualEnrollment(ctx, &device.Device{UUID: "manual-2", UDID: "UDID-manual-2", Enrolled: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	// re-enrolling with a new uuid updates the device with the same udid.
+	uuid, err = db.SaveManualEnrollment(ctx, &device.Device{
+		UUID:         "manual-1-again",
+		UDID:         "UDID-manual-1",
+		SerialNumber: "C02MANUAL1",
+		Enrolled:     true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := uuid, "manual-1"; have != want {
+		t.Errorf("re-enrollment: have uuid %s, want %s", have, want)
+	}
+
+	found, err := db.Devices(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := len(found), 2; have != want {
+		t.Fatalf("have %d devices, want %d", have, want)
+	}
+	if have, want := found[0].SerialNumber, "C02MANUAL1"; have != want {
+		t.Errorf("have serial %q, want %q", have, want)
+	}
+
+	if _, err := db.SaveManualEnrollment(ctx, &device.Device{UUID: "manual-3", SerialNumber: "C02MANUAL3"}); err == nil {
+		t.Error("expected an error saving a manual enrollment without a udid")
+	}
+}
+
+func TestUDIDUniqueWhenSet(t *testing.T) {
+	db := setup(t)
+	ctx := context.Background()
+	resetDevices(t, db)
+	defer resetDevices(t, db)
+
+	for _, dev := range []*device.Device{
+		{UUID: "dep-only-1", SerialNumber: "C02DEPONLY1"},
+		{UUID: "dep-only-2", SerialNumber: "C02DEPONLY2"},
+		{UUID: "enrolled-1", UDID: "UDID-enrolled-1", Enrolled: true},
+		{UUID: "enrolled-2", UDID: "UDID-enrolled-2", Enrolled: true},
+	} {
+		if err := db.Save(ctx, dev); err != nil {
+			t.Fatalf("saving %s: %v", dev.UUID, err)
+		}
+	}
+
+	if err := db.Save(ctx, &device.Device{UUID: "enrolled-3", UDID: "UDID-enrolled-1"}); err == nil {
+		t.Error("expected an error saving a second device with the same udid")
+	}
+}
+
+func TestReenrollAfterDelete(t *testing.T) {
+	db := setup(t)
+	ctx := context.Background()
+	resetDevices(t, db)
+	defer resetDevices(t, db)
+
+	if err := db.Save(ctx, &device.Device{UUID: "reenroll-1", UDID: "UDID-reenroll", Enrolled: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DeleteDevice(ctx, "reenroll-1"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the deleted device is hidden, so the worker saves the udid under a new uuid.
+	if err := db.Save(ctx, &device.Device{UUID: "reenroll-2", UDID: "UDID-reenroll", Enrolled: true}); err != nil {
+		t.Fatalf("saving the udid of a deleted device: %v", err)
+	}
+	if err := db.DeleteDevice(ctx, "reenroll-2"); err != nil {
+		t.Fatal(err)
+	}
+	uuid, err := db.SaveManualEnrollment(ctx, &device.Device{UUID: "reenroll-3", UDID: "UDID-reenroll", Enrolled: true})
+	if err != nil {
+		t.Fatalf("manual enrollment of the udid of a deleted device: %v", err)
+	}
+	if have, want := uuid, "reenroll-3"; have != want {
+		t.Errorf("have uuid %s, want %s", have, want)
+	}
+
+	found, err := db.DeviceByUDID(ctx, "UDID-reenroll")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := found.UUID, "reenroll-3"; have != want {
+		t.Errorf("have uuid %s, want %s", have, want)
+	}
+}
+
+func TestBulkSave(t *testing.T) {
+	db := setup(t)
+	ctx := context.Background()
+	resetDevices(t, db)
+	defer resetDevices(t, db)
+
+	devs := []*device.Device{
+		{UUID: "bulk-1", UDID: "bulk-1", DEPProfileStatus: device.EMPTY},
+		{UUID: "bulk-2", UDID: "bulk-2", DEPProfileStatus: device.EMPTY},
+	}
+	if err := db.BulkSave(ctx, devs); err != nil {
+		t.Fatal(err)
+	}
+
+	// saving the same devices again updates them in place.
+	for _, dev := range devs {
+		dev.DEPProfileStatus = device.ASSIGNED
+	}
+	if err := db.BulkSave(ctx, devs); err != nil {
+		t.Fatal(err)
+	}
+
+	found, err := db.Devices(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := len(found), len(devs); have != want {
+		t.Fatalf("have %d devices, want %d", have, want)
+	}
+	for _, dev := range found {
+		if have, want := dev.DEPProfileStatus, device.DEPProfileStatus(device.ASSIGNED); have != want {
+			t.Errorf("have %s, want %s", have, want)
+		}
+	}
+}
+
+func TestMergeDevices(t *testing.T) {
+	db := setup(t)
+	ctx := context.Background()
+	resetDevices(t, db)
+	defer resetDevices(t, db)
+
+	// the DEP record of the device, and the record saved when it enrolled again with a profile
+	// which does not report the serial number.
+	keep := &device.Device{UUID: "merge-keep", SerialNumber: "C02MERGE", Model: "MacBookPro15,1", DEPProfileUUID: "profile-1", AssetTag: "IT-0042"}
+	merge := &device.Device{UUID: "merge-dup", UDID: "UDID-NEW", Enrolled: true, Token: "tok", PushMagic: "magic", OSVersion: "10.15.3"}
+	for _, dev := range []*device.Device{keep, merge} {
+		if err := db.Save(ctx, dev); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := db.AssignWorkflow(ctx, []string{"merge-dup"}, "workflow-1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddTags(ctx, "merge-keep", "finance"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddTags(ctx, "merge-dup", "finance", "laptops"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.MergeDevices(ctx, "merge-keep", "merge-dup"); err != nil {
+		t.Fatal(err)
+	}
+
+	merged, err := db.DeviceByUDID(ctx, "UDID-NEW")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := device.Device{
+		UUID:           "merge-keep",
+		UDID:           "UDID-NEW",
+		SerialNumber:   "C02MERGE",
+		Model:          "MacBookPro15,1",
+		DEPProfileUUID: "profile-1",
+		AssetTag:       "IT-0042",
+		Enrolled:       true,
+		Token:          "tok",
+		PushMagic:      "magic",
+		OSVersion:      "10.15.3",
+	}
+	merged.CreatedAt, merged.UpdatedAt = time.Time{}, time.Time{}
+	if *merged != want {
+		t.Errorf("have %+v, want %+v", *merged, want)
+	}
+
+	if found, err := db.Devices(ctx, UUID{UUID: "merge-dup"}, IncludeDeleted{}); err != nil || len(found) != 0 {
+		t.Errorf("merged device not deleted: %v, %v", found, err)
+	}
+	if found, err := db.Devices(ctx, WorkflowUUID{UUID: "workflow-1"}); err != nil || len(found) != 1 {
+		t.Errorf("workflow not merged: %v, %v", found, err)
+	}
+	for _, tag := range []string{"finance", "laptops"} {
+		if found, err := db.Devices(ctx, HasTag{Tag: tag}); err != nil || len(found) != 1 || found[0].UUID != "merge-keep" {
+			t.Errorf("tag %s not merged: %v, %v", tag, found, err)
+		}
+	}
+
+	if err := db.MergeDevices(ctx, "merge-keep", "merge-dup"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("merging a deleted device: have %v, want ErrNotFound", err)
+	}
+}
+
+func TestMergeEmptyDevice(t *testing.T) {
+	db := setup(t)
+	ctx := context.Background()
+	resetDevices(t, db)
+	defer resetDevices(t, db)
+
+	keep := &device.Device{UUID: "merge-keep", SerialNumber: "C02MERGE", Model: "MacBookPro15,1"}
+	if err := db.Save(ctx, keep); err != nil {
+		t.Fatal(err)
+	}
+	// a row with nothing but a uuid, which Save would reject.
+	if _, err := db.db.ExecContext(ctx, `INSERT INTO devices (uuid) VALUES ('merge-empty')`); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.MergeDevices(ctx, "merge-keep", "merge-empty"); err != nil {
+		t.Fatal(err)
+	}
+
+	found, err := db.DeviceBySerial(ctx, "C02MERGE")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found.UUID != keep.UUID || found.Model != keep.Model {
+		t.Errorf("kept device changed: have %+v", *found)
+	}
+	if found, err := db.Devices(ctx, UUID{UUID: "merge-empty"}, IncludeDeleted{}); err != nil || len(found) != 0 {
+		t.Errorf("merged device not deleted: %v, %v", found, err)
+	}
+}
+
+func TestBulkSaveBatchSize(t *testing.T) {
+	db := New(setup(t).db, WithBatchSize(100))
+	ctx := context.Background()
+	resetDevices(t, db)
+	defer resetDevices(t, db)
+
+	if err := db.BulkSave(ctx, benchmarkDevices(1000)); err != nil {
+		t.Fatal(err)
+	}
+	n, err := db.CountDevices(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := n, 1000; have != want {
+		t.Errorf("have %d devices, want %d", have, want)
+	}
+
+	// a device failing to save in the third batch leaves the first two batches saved.
+	resetDevices(t, db)
+	if err := db.Save(ctx, &device.Device{UUID: "taken", SerialNumber: "bench-230"}); err != nil {
+		t.Fatal(err)
+	}
+	devs := benchmarkDevices(250)
+	err = db.BulkSave(ctx, devs)
+	if err == nil || !strings.Contains(err.Error(), "bulk save batch 3, after saving 200 devices") {
+		t.Errorf("have %v, want an error naming batch 3", err)
+	}
+	if n, err := db.CountDevices(ctx); err != nil || n != 201 {
+		t.Errorf("have %d devices saved, %v, want 200 and the conflicting device", n, err)
+	}
+}
+
+func TestWithTxRollback(t *testing.T) {
+	db := setup(t)
+	ctx := context.Background()
+	resetDevices(t, db)
+	defer resetDevices(t, db)
+
+	errAbort := errors.New("abort")
+	err := db.WithTx(ctx, func(tx Store) error {
+		if err := tx.Save(ctx, &device.Device{UUID: "tx-1", UDID: "tx-1"}); err != nil {
+			return err
+		}
+		if _, err := tx.AssignWorkflow(ctx, []string{"tx-1"}, "wf-tx"); err != nil {
+			return err
+		}
+		// the transaction sees its own writes.
+		if _, err := tx.DeviceByUDID(ctx, "tx-1"); err != nil {
+			return err
+		}
+		return errAbort
+	})
+	if err != errAbort {
+		t.Fatalf("have %v, want %v", err, errAbort)
+	}
+
+	if _, err := db.DeviceByUDID(ctx, "tx-1"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("device saved in a rolled back transaction: have %v, want ErrNotFound", err)
+	}
+}
+
+func TestWithTxCommit(t *testing.T) {
+	db := setup(t)
+	ctx := context.Background()
+	resetDevices(t, db)
+	defer resetDevices(t, db)
+
+	err := db.WithTx(ctx, func(tx Store) error {
+		if err := tx.Save(ctx, &device.Device{UUID: "tx-2", UDID: "tx-2"}); err != nil {
+			return err
+		}
+		_, err := tx.AssignWorkflow(ctx, []string{"tx-2"}, "wf-tx")
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found, err := db.Devices(ctx, WorkflowUUID{UUID: "wf-tx"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := len(found), 1; have != want {
+		t.Errorf("have %d devices, want %d", have, want)
+	}
+}
+
+func BenchmarkSave(b *testing.B) {
+	db := setup(b)
+	ctx := context.Background()
+	devs := benchmarkDevices(100)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, dev := range devs {
+			if err := db.Save(ctx, dev); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkBulkSave(b *testing.B) {
+	db := setup(b)
+	ctx := context.Background()
+	devs := benchmarkDevices(100)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := db.BulkSave(ctx, devs); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func benchmarkDevices(n int) []*device.Device {
+	devs := make([]*device.Device, n)
+	for i := range devs {
+		id := fmt.Sprintf("bench-%d", i)
+		devs[i] = &device.Device{UUID: id, UDID: id, SerialNumber: id}
+	}
+	return devs
+}
+
+func TestDeviceBySerial(t *testing.T) {
+	db := setup(t)
+	ctx := context.Background()
+
+	dev := &device.Device{UUID: "by-serial-test", UDID: "by-serial-test", SerialNumber: "C02BYSERIAL"}
+	if err := db.Save(ctx, dev); err != nil {
+		t.Fatal(err)
+	}
+	defer db.DeleteByUDID(ctx, dev.UDID)
+
+	found, err := db.DeviceBySerial(ctx, dev.SerialNumber)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := found.UUID, dev.UUID; have != want {
+		t.Errorf("have %s, want %s", have, want)
+	}
+
+	_, err = db.DeviceBySerial(ctx, "C02UNKNOWN")
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("have %v, want %v", err, ErrNotFound)
+	}
+}
+
+func TestDeviceByIMEIAndMEID(t *testing.T) {
+	db := setup(t)
+	ctx := context.Background()
+	resetDevices(t, db)
+	defer resetDevices(t, db)
+
+	cellular := device.Device{UUID: "cellular", UDID: "UDID-cellular", IMEI: "35 123456 789012 3", MEID: "35123456789012"}
+	wifi := device.Device{UUID: "wifi", UDID: "UDID-wifi"}
+	for _, dev := range []*device.Device{&cellular, &wifi} {
+		if err := db.Save(ctx, dev); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	lookups := []struct {
+		name   string
+		lookup func(context.Context, string) (*device.Device, error)
+		value  string
+	}{
+		{"imei", db.DeviceByIMEI, cellular.IMEI},
+		{"meid", db.DeviceByMEID, cellular.MEID},
+	}
+	for _, tt := range lookups {
+		found, err := tt.lookup(ctx, tt.value)
+		if err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+		if have, want := found.UUID, cellular.UUID; have != want {
+			t.Errorf("%s: have %s, want %s", tt.name, have, want)
+		}
+
+		if _, err := tt.lookup(ctx, "does-not-exist"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("%s: unknown value: have %v, want ErrNotFound", tt.name, err)
+		}
+		if _, err := tt.lookup(ctx, ""); !errors.Is(err, ErrNotFound) {
+			t.Errorf("%s: empty value: have %v, want ErrNotFound", tt.name, err)
+		}
+	}
+}
+
+func TestDeviceByAssetTag(t *testing.T) {
+	db := setup(t)
+	ctx := context.Background()
+	resetDevices(t, db)
+	defer resetDevices(t, db)
+
+	for _, dev := range []*device.Device{
+		{UUID: "tagged", SerialNumber: "C02TAGGED", AssetTag: "IT-0001"},
+		{UUID: "untagged-1", SerialNumber: "C02UNTAGGED1"},
+		{UUID: "untagged-2", SerialNumber: "C02UNTAGGED2"},
+	} {
+		if err := db.Save(ctx, dev); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	found, err := db.DeviceByAssetTag(ctx, "IT-0001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := found.UUID, "tagged"; have != want {
+		t.Errorf("have %s, want %s", have, want)
+	}
+	if _, err := db.DeviceByAssetTag(ctx, ""); !errors.Is(err, ErrNotFound) {
+		t.Errorf("empty tag: have %v, want ErrNotFound", err)
+	}
+
+	// assigning the tag to a second device is rejected, by Save and UpdateDevice.
+	err = db.Save(ctx, &device.Device{UUID: "untagged-1", SerialNumber: "C02UNTAGGED1", AssetTag: "IT-0001"})
+	if err == nil || !strings.Contains(err.Error(), `asset tag "IT-0001" of device untagged-1 is already assigned`) {
+		t.Errorf("Save: have %v, want an asset tag conflict", err)
+	}
+	err = db.UpdateDevice(ctx, &device.Device{UUID: "untagged-2", AssetTag: "IT-0001"})
+	if err == nil || !strings.Contains(err.Error(), `asset tag "IT-0001" of device untagged-2 is already assigned`) {
+		t.Errorf("UpdateDevice: have %v, want an asset tag conflict", err)
+	}
+
+	// the asset tag of a soft deleted device can be saved again.
+	if err := db.DeleteDevice(ctx, "tagged"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Save(ctx, &device.Device{UUID: "untagged-1", SerialNumber: "C02UNTAGGED1", AssetTag: "IT-0001"}); err != nil {
+		t.Errorf("saving the asset tag of a deleted device: %v", err)
+	}
+	found, err = db.DeviceByAssetTag(ctx, "IT-0001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := found.UUID, "untagged-1"; have != want {
+		t.Errorf("have %s, want %s", have, want)
+	}
+}
+
+func TestDeviceByPushToken(t *testing.T) {
+	db := setup(t)
+	ctx := context.Background()
+	resetDevices(t, db)
+	defer resetDevices(t, db)
+
+	dev := device.Device{UUID: "push-token", UDID: "UDID-push-token", Token: "746f6b656e", Enrolled: true}
+	if err := db.Save(ctx, &dev); err != nil {
+		t.Fatal(err)
+	}
+
+	found, err := db.DeviceByPushToken(ctx, dev.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := found.UDID, dev.UDID; have != want {
+		t.Errorf("have %s, want %s", have, want)
+	}
+
+	if _, err := db.DeviceByPushToken(ctx, "unknown-token"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("unknown token: have %v, want ErrNotFound", err)
+	}
+}
+
+func TestDeviceExists(t *testing.T) {
+	db := setup(t)
+	ctx := context.Background()
+	resetDevices(t, db)
+	defer resetDevices(t, db)
+
+	for _, dev := range []*device.Device{
+		{UUID: "exists", SerialNumber: "C02EXISTS"},
+		{UUID: "exists-deleted", SerialNumber: "C02DELETED"},
+	} {
+		if err := db.Save(ctx, dev); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.DeleteDevice(ctx, "exists-deleted"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		serial string
+		want   bool
+	}{
+		{"C02EXISTS", true},
+		{"c02exists", true},
+		{"C02MISSING", false},
+		{"C02DELETED", false},
+	}
+	for _, tt := range tests {
+		exists, err := db.DeviceExists(ctx, tt.serial)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if exists != tt.want {
+			t.Errorf("%s: have %v, want %v", tt.serial, exists, tt.want)
+		}
+	}
+}
+
+func TestSerialNumberNormalized(t *testing.T) {
+	db := setup(t)
+	ctx := context.Background()
+
+	dev := &device.Device{UUID: "normalize-test", UDID: "normalize-test", SerialNumber: " c02abc123 "}
+	if err := db.Save(ctx, dev); err != nil {
+		t.Fatal(err)
+	}
+	defer db.DeleteByUDID(ctx, dev.UDID)
+
+	found, err := db.DeviceBySerial(ctx, "C02aBc123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := found.SerialNumber, "C02ABC123"; have != want {
+		t.Errorf("have %q, want %q", have, want)
+	}
+
+	list, err := db.Devices(ctx, SerialNumber{SerialNumber: "c02abc123"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := len(list), 1; have != want {
+		t.Errorf("have %d devices, want %d", have, want)
+	}
+}
+
+func TestScanNullColumns(t *testing.T) {
+	db := setup(t)
+	ctx := context.Background()
+	resetDevices(t, db)
+	defer resetDevices(t, db)
+
+	// a device inserted by another tool, with only the columns it knows about.
+	var nulls []string
+	for col := range nullableColumns {
+		if col != "udid" && col != "serial_number" {
+			nulls = append(nulls, col+" = NULL")
+		}
+	}
+	if err := db.Save(ctx, &device.Device{UUID: "dep-only", UDID: "dep-only", SerialNumber: "NULLS1"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.db.ExecContext(ctx, `UPDATE devices SET `+strings.Join(nulls, ", ")+` WHERE uuid = 'dep-only'`); err != nil {
+		t.Fatal(err)
+	}
+
+	found, err := db.Devices(ctx, SerialNumber{SerialNumber: "NULLS1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := len(found), 1; have != want {
+		t.Fatalf("have %d devices, want %d", have, want)
+	}
+
+	dev, err := db.DeviceByUDID(ctx, "dep-only")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dev.OSVersion != "" || dev.Enrolled || dev.TotalStorage != 0 {
+		t.Errorf("NULL columns did not scan into zero values: %+v", dev)
+	}
+	if !dev.LastSeen.IsZero() || dev.DEPProfileAssignTime != nil {
+		t.Errorf("NULL timestamps did not scan into zero times: %v, %v", dev.LastSeen, dev.DEPProfileAssignTime)
+	}
+}
+
+func TestUpdateDevice(t *testing.T) {
+	db := setup(t)
+	ctx := context.Background()
+
+	dev := &device.Device{UUID: "update-test", UDID: "update-test", SerialNumber: "C02UPDATE"}
+	if err := db.Save(ctx, dev); err != nil {
+		t.Fatal(err)
+	}
+	defer db.DeleteByUDID(ctx, dev.UDID)
+
+	if err := db.UpdateDevice(ctx, &device.Device{UUID: dev.UUID, AssetTag: "ASSET-42"}); err != nil {
+		t.Fatal(err)
+	}
+
+	found, err := db.DeviceByUDID(ctx, dev.UDID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := found.AssetTag, "ASSET-42"; have != want {
+		t.Errorf("have %s, want %s", have, want)
+	}
+	// fields not set on the update are preserved.
+	if have, want := found.SerialNumber, dev.SerialNumber; have != want {
+		t.Errorf("have %s, want %s", have, want)
+	}
+
+	err = db.UpdateDevice(ctx, &device.Device{UUID: "does-not-exist", AssetTag: "ASSET-42"})
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("have %v, want %v", err, ErrNotFound)
+	}
+
+	if err := db.DeleteDevice(ctx, dev.UUID); err != nil {
+		t.Fatal(err)
+	}
+	err = db.UpdateDevice(ctx, &device.Device{UUID: dev.UUID, AssetTag: "ASSET-43"})
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("update of a deleted device: have %v, want %v", err, ErrNotFound)
+	}
+}
+
+func TestListDevicesExcludesDeleted(t *testing.T) {
+	db := setup(t)
+	ctx := context.Background()
+	resetDevices(t, db)
+	defer resetDevices(t, db)
+
+	for _, id := range []string{"list-1", "list-2"} {
+		if err := db.Save(ctx, &device.Device{UUID: id, UDID: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.DeleteDevice(ctx, "list-2"); err != nil {
+		t.Fatal(err)
+	}
+
+	devices, err := db.ListDevices(ctx, device.ListDevicesOption{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := deviceUUIDs(devices), []string{"list-1"}; !reflect.DeepEqual(have, want) {
+		t.Errorf("have %v, want %v", have, want)
+	}
+}
+
+func TestStorageRoundTrip(t *testing.T) {
+	db := setup(t)
+	ctx := context.Background()
+	resetDevices(t, db)
+	defer resetDevices(t, db)
+
+	dev := device.Device{
+		UUID:             "storage",
+		UDID:             "UDID-storage",
+		DeviceName:       "Lab iPad",
+		TotalStorage:     128000000000,
+		AvailableStorage: 3500000000,
+	}
+	if err := db.Save(ctx, &dev); err != nil {
+		t.Fatal(err)
+	}
+
+	found, err := db.Devices(ctx, UUID{UUID: dev.UUID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := len(found), 1; have != want {
+		t.Fatalf("have %d devices, want %d", have, want)
+	}
+	if have, want := found[0], dev; have.DeviceName != want.DeviceName ||
+		have.TotalStorage != want.TotalStorage ||
+		have.AvailableStorage != want.AvailableStorage {
+		t.Errorf("have (%q, %d, %d), want (%q, %d, %d)",
+			have.DeviceName, have.TotalStorage, have.AvailableStorage,
+			want.DeviceName, want.TotalStorage, want.AvailableStorage)
+	}
+}
+
+func TestUpdateFromDeviceInformation(t *testing.T) {
+	db := setup(t)
+	ctx := context.Background()
+	resetDevices(t, db)
+	defer resetDevices(t, db)
+
+	dev := device.Device{UUID: "devinfo", UDID: "UDID-devinfo", OSVersion: "11.4"}
+	if err := db.Save(ctx, &dev); err != nil {
+		t.Fatal(err)
+	}
+
+	responses := map[string]interface{}{
+		"OSVersion":               "12.0",
+		"BuildVersion":            "16A366",
+		"ProductName":             "iPhone10,4",
+		"ModelName":               "iPhone",
+		"DeviceName":              "Front Desk iPhone",
+		"BatteryLevel":            0.85,
+		"IsSupervised":            true,
+		"DeviceCapacity":          64.0,
+		"AvailableDeviceCapacity": 42.5,
+	}
+	if err := db.UpdateFromDeviceInformation(ctx, dev.UDID, responses); err != nil {
+		t.Fatal(err)
+	}
+
+	found, err := db.DeviceByUDID(ctx, dev.UDID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	have := []string{found.OSVersion, found.BuildVersion, found.ProductName, found.ModelName, found.DeviceName}
+	want := []string{"12.0", "16A366", "iPhone10,4", "iPhone", "Front Desk iPhone"}
+	if fmt.Sprint(have) != fmt.Sprint(want) {
+		t.Errorf("have %q, want %q", have, want)
+	}
+	if found.TotalStorage != 64000000000 || found.AvailableStorage != 42500000000 {
+		t.Errorf("storage: have (%d, %d), want (64000000000, 42500000000)", found.TotalStorage, found.AvailableStorage)
+	}
+
+	err = db.UpdateFromDeviceInformation(ctx, "UDID-missing", map[string]interface{}{"OSVersion": "12.0"})
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("unknown udid: have %v, want ErrNotFound", err)
+	}
+}
+
+func TestDeleteDevice(t *testing.T) {
+	db := setup(t)
+	ctx := context.Background()
+
+	dev := &device.Device{UUID: "soft-delete-test", UDID: "soft-delete-test"}
+	if err := db.Save(ctx, dev); err != nil {
+		t.Fatal(err)
+	}
+	defer db.DeleteByUDID(ctx, dev.UDID)
+
+	if err := db.DeleteDevice(ctx, dev.UUID); err != nil {
+		t.Fatal(err)
+	}
+
+	found, err := db.Devices(ctx, UUID{UUID: dev.UUID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := len(found), 0; have != want {
+		t.Errorf("default listing: have %d devices, want %d", have, want)
+	}
+
+	found, err = db.Devices(ctx, UUID{UUID: dev.UUID}, IncludeDeleted{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := len(found), 1; have != want {
+		t.Errorf("IncludeDeleted listing: have %d devices, want %d", have, want)
+	}
+
+	if _, err := db.DeviceByUDID(ctx, dev.UDID); err == nil {
+		t.Error("expected soft deleted device to be not found by udid")
+	}
+
+	if err := db.DeleteDevice(ctx, dev.UUID); err == nil {
+		t.Error("expected error deleting an already deleted device")
+	}
+}
+
+func TestDevicesReturnsAllColumns(t *testing.T) {
+	db := setup(t)
+	ctx := context.Background()
+	resetDevices(t, db)
+	defer resetDevices(t, db)
+
+	dev := device.Device{
+		UUID:      "all-columns",
+		UDID:      "UDID-all-columns",
+		OSVersion: "12.1",
+		Color:     "space gray",
+		AssetTag:  "IT-0042",
+	}
+	if err := db.Save(ctx, &dev); err != nil {
+		t.Fatal(err)
+	}
+
+	found, err := db.Devices(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := len(found), 1; have != want {
+		t.Fatalf("have %d devices, want %d", have, want)
+	}
+	if have := found[0]; have.OSVersion != dev.OSVersion || have.Color != dev.Color || have.AssetTag != dev.AssetTag {
+		t.Errorf("have (%q, %q, %q), want (%q, %q, %q)",
+			have.OSVersion, have.Color, have.AssetTag,
+			dev.OSVersion, dev.Color, dev.AssetTag)
+	}
+}
+
+func TestReapUnenrolled(t *testing.T) {
+	db := setup(t)
+	ctx := context.Background()
+	resetDevices(t, db)
+	defer resetDevices(t, db)
+
+	now := time.Now().UTC()
+	lastMonth := now.Add(-30 * 24 * time.Hour)
+	for _, dev := range []*device.Device{
+		{UUID: "stale-dep", SerialNumber: "C02STALE", DEPProfileAssignedDate: &lastMonth},
+		{UUID: "recent-dep", SerialNumber: "C02RECENT", DEPProfileAssignedDate: &now},
+		{UUID: "enrolled-dep", SerialNumber: "C02ENROLLED", Enrolled: true, DEPProfileAssignedDate: &lastMonth},
+		{UUID: "checked-out-dep", SerialNumber: "C02CHECKEDOUT", Enrolled: true, DEPProfileAssignedDate: &lastMonth},
+		{UUID: "never-dep", UDID: "UDID-never-dep"},
+	} {
+		if err := db.Save(ctx, dev); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a device which enrolled, then checked out.
+	if err := db.Save(ctx, &device.Device{UUID: "checked-out-dep", SerialNumber: "C02CHECKEDOUT", DEPProfileAssignedDate: &lastMonth}); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := db.ReapUnenrolled(ctx, now.Add(-7*24*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := n, 1; have != want {
+		t.Errorf("have %d reaped, want %d", have, want)
+	}
+
+	remaining, err := db.Devices(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, dev := range remaining {
+		ids = append(ids, dev.UUID)
+	}
+	if have, want := strings.Join(ids, ","), "checked-out-dep,enrolled-dep,never-dep,recent-dep"; have != want {
+		t.Errorf("remaining devices: have %s, want %s", have, want)
+	}
+}
+
+func TestExportImportDevices(t *testing.T) {
+	db := setup(t)
+	ctx := context.Background()
+	resetDevices(t, db)
+	defer resetDevices(t, db)
+
+	assigned := time.Now()
+	for _, dev := range []*device.Device{
+		{UUID: "export-1", UDID: "UDID-export-1", SerialNumber: "C02EXPORT1", Enrolled: true, Color: "silver", LastSeen: time.Now()},
+		{UUID: "export-2", SerialNumber: "C02EXPORT2", DEPProfileStatus: device.ASSIGNED, DEPProfileAssignedDate: &assigned},
+	} {
+		if err := db.Save(ctx, dev); err != nil {
+			t.Fatal(err)
+		}
+	}
+	exported, err := db.Devices(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := db.ExportDevices(ctx, &buf); err != nil {
+		t.Fatal(err)
+	}
+	if have, want := strings.Count(buf.String(), "\n"), len(exported); have != want {
+		t.Errorf("have %d lines, want %d", have, want)
+	}
+
+	resetDevices(t, db)
+	n, err := db.ImportDevices(ctx, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := n, len(exported); have != want {
+		t.Errorf("have %d imported, want %d", have, want)
+	}
+
+	imported, err := db.Devices(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the imported rows are new, so the database sets new timestamps.
+	for _, list := range [][]device.Device{imported, exported} {
+		for i := range list {
+			list[i].CreatedAt, list[i].UpdatedAt = time.Time{}, time.Time{}
+		}
+	}
+	if !reflect.DeepEqual(imported, exported) {
+		t.Errorf("have %+v, want %+v", imported, exported)
+	}
+}
+
+func TestImportDevicesInvalidJSON(t *testing.T) {
+	db := lazySetup(t)
+	n, err := db.ImportDevices(context.Background(), strings.NewReader("{not json}\n"))
+	if err == nil {
+		t.Fatal("expected an error importing invalid JSON")
+	}
+	if n != 0 {
+		t.Errorf("have %d imported, want 0", n)
+	}
+}
+
+func TestDevicesIter(t *testing.T) {
+	db := setup(t)
+	ctx := context.Background()
+	resetDevices(t, db)
+	defer resetDevices(t, db)
+
+	const n = 300
+	if err := db.BulkSave(ctx, benchmarkDevices(n)); err != nil {
+		t.Fatal(err)
+	}
+
+	rows, err := db.DevicesIter(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var count int
+	seen := make(map[string]bool)
+	for rows.Next() {
+		dev := rows.Device()
+		if seen[dev.UUID] {
+			t.Fatalf("device %s returned twice", dev.UUID)
+		}
+		seen[dev.UUID] = true
+		count++
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if err := rows.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if have, want := count, n; have != want {
+		t.Errorf("have %d devices, want %d", have, want)
+	}
+
+	// iterating to the end releases the connection.
+	if have, want := db.db.Stats().InUse, 0; have != want {
+		t.Errorf("have %d connections in use, want %d", have, want)
+	}
+}
+
+func TestDevicesUUIDFilterIsParameterized(t *testing.T) {
+	db := setup(t)
+	ctx := context.Background()
+
+	dev := &device.Device{UUID: "injection-test", UDID: "injection-test"}
+	if err := db.Save(ctx, dev); err != nil {
+		t.Fatal(err)
+	}
+	defer db.DeleteByUDID(ctx, dev.UDID)
+
+	malicious := UUID{UUID: "'; DROP TABLE devices;--"}
+	devices, err := db.Devices(ctx, malicious)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := len(devices), 0; have != want {
+		t.Errorf("have %d devices, want %d", have, want)
+	}
+
+	// the table must still exist and contain the device saved above.
+	devices, err = db.Devices(ctx, UUID{UUID: dev.UUID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := len(devices), 1; have != want {
+		t.Errorf("have %d devices, want %d", have, want)
+	}
+}
+
+func TestDevicesUUIDsFilter(t *testing.T) {
+	db := setup(t)
+	ctx := context.Background()
+	resetDevices(t, db)
+	defer resetDevices(t, db)
+
+	for _, id := range []string{"batch-1", "batch-2", "batch-3", "batch-4"} {
+		if err := db.Save(ctx, &device.Device{UUID: id, UDID: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	found, err := db.Devices(ctx, UUIDs{UUIDs: []string{"batch-2", "batch-4", "does-not-exist"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, dev := range found {
+		ids = append(ids, dev.UUID)
+	}
+	if have, want := strings.Join(ids, ","), "batch-2,batch-4"; have != want {
+		t.Errorf("have %s, want %s", have, want)
+	}
+
+	found, err = db.Devices(ctx, UUIDs{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := len(found), 0; have != want {
+		t.Errorf("empty list: have %d devices, want %d", have, want)
+	}
+}
+
+func TestSelectDevicesUUIDsFilter(t *testing.T) {
+	stmt, err := selectDevices(tableName, tagTableName, UUIDs{UUIDs: []string{"a", "b", "c"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	query, args, err := stmt.ToSql()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(query, "WHERE uuid = ANY($1)") {
+		t.Errorf("query %q does not bind the uuids as one array", query)
+	}
+	if have, want := len(args), 1; have != want {
+		t.Errorf("have %d args, want %d", have, want)
+	}
+}
+
+func TestDevicesSerialNumberFilter(t *testing.T) {
+	db := setup(t)
+	ctx := context.Background()
+
+	devs := []*device.Device{
+		{UUID: "serial-filter-1", UDID: "serial-filter-1", SerialNumber: "C02SERIAL1"},
+		{UUID: "serial-filter-2", UDID: "serial-filter-2", SerialNumber: "C02SERIAL2"},
+	}
+	for _, dev := range devs {
+		if err := db.Save(ctx, dev); err != nil {
+			t.Fatal(err)
+		}
+		defer db.DeleteByUDID(ctx, dev.UDID)
+	}
+
+	found, err := db.Devices(ctx, SerialNumber{SerialNumber: "C02SERIAL2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := len(found), 1; have != want {
+		t.Fatalf("have %d devices, want %d", have, want)
+	}
+	if have, want := found[0].UUID, "serial-filter-2"; have != want {
+		t.Errorf("have %s, want %s", have, want)
+	}
+
+	found, err = db.Devices(ctx, UUID{UUID: "serial-filter-1"}, SerialNumber{SerialNumber: "C02SERIAL2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := len(found), 0; have != want {
+		t.Errorf("have %d devices, want %d", have, want)
+	}
+}
+
+func TestDevicesLimitOffset(t *testing.T) {
+	db := setup(t)
+	ctx := context.Background()
+	resetDevices(t, db)
+
+	for _, id := range []string{"page-1", "page-2", "page-3", "page-4", "page-5"} {
+		if err := db.Save(ctx, &device.Device{UUID: id, UDID: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer resetDevices(t, db)
+
+	found, err := db.Devices(ctx, Limit{N: 2}, Offset{N: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := len(found), 2; have != want {
+		t.Fatalf("have %d devices, want %d", have, want)
+	}
+	if have, want := found[0].UUID, "page-3"; have != want {
+		t.Errorf("have %s, want %s", have, want)
+	}
+	if have, want := found[1].UUID, "page-4"; have != want {
+		t.Errorf("have %s, want %s", have, want)
+	}
+
+	// a zero limit means no limit, and offset works on its own.
+	found, err = db.Devices(ctx, Limit{N: 0}, Offset{N: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := len(found), 2; have != want {
+		t.Errorf("have %d devices, want %d", have, want)
+	}
+}
+
+func TestDevicesAfter(t *testing.T) {
+	db := setup(t)
+	ctx := context.Background()
+	resetDevices(t, db)
+	defer resetDevices(t, db)
+
+	const n = 23
+	if err := db.BulkSave(ctx, benchmarkDevices(n)); err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		pages int
+		after string
+		seen  []string
+	)
+	for {
+		page, err := db.DevicesAfter(ctx, after, 5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(page) == 0 {
+			break
+		}
+		pages++
+		for _, dev := range page {
+			seen = append(seen, dev.UUID)
+		}
+		after = page[len(page)-1].UUID
+	}
+
+	if have, want := pages, 5; have != want {
+		t.Errorf("have %d pages, want %d", have, want)
+	}
+	if have, want := len(seen), n; have != want {
+		t.Fatalf("have %d devices, want %d", have, want)
+	}
+	for i := 1; i < len(seen); i++ {
+		if seen[i] <= seen[i-1] {
+			t.Errorf("device %s follows %s, want strictly increasing uuids", seen[i], seen[i-1])
+		}
+	}
+}
+
+func TestSelectDevicesLimitOffset(t *testing.T) {
+	stmt, err := selectDevices(tableName, tagTableName, Limit{N: 10}, Offset{N: 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	query, _, err := stmt.ToSql()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(query, "LIMIT 10 OFFSET 20") {
+		t.Errorf("missing LIMIT/OFFSET clause: %s", query)
+	}
+
+	if _, err := selectDevices(tableName, tagTableName, Limit{N: -1}); err == nil {
+		t.Error("expected error for negative limit")
+	}
+}
+
+func TestDevicesOrderBy(t *testing.T) {
+	db := setup(t)
+	ctx := context.Background()
+	resetDevices(t, db)
+
+	devs := []*device.Device{
+		{UUID: "order-1", UDID: "order-1", SerialNumber: "B"},
+		{UUID: "order-2", UDID: "order-2", SerialNumber: "C"},
+		{UUID: "order-3", UDID: "order-3", SerialNumber: "A"},
+	}
+	for _, dev := range devs {
+		if err := db.Save(ctx, dev); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer resetDevices(t, db)
+
+	serials := func(devices []device.Device) string {
+		var s string
+		for _, d := range devices {
+			s += d.SerialNumber
+		}
+		return s
+	}
+
+	asc, err := db.Devices(ctx, OrderBy{Column: "serial_number"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := serials(asc), "ABC"; have != want {
+		t.Errorf("ascending: have %s, want %s", have, want)
+	}
+
+	desc, err := db.Devices(ctx, OrderBy{Column: "serial_number", Desc: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := serials(desc), "CBA"; have != want {
+		t.Errorf("descending: have %s, want %s", have, want)
+	}
+
+	if _, err := db.Devices(ctx, OrderBy{Column: "token; DROP TABLE devices"}); err == nil {
+		t.Error("expected error ordering by an unknown column")
+	}
+}
+
+func TestSelectDevicesOrderBy(t *testing.T) {
+	stmt, err := selectDevices(tableName, tagTableName, OrderBy{Column: "model", Desc: true}, Limit{N: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	query, _, err := stmt.ToSql()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(query, "ORDER BY model DESC LIMIT 5") {
+		t.Errorf("missing ORDER BY clause: %s", query)
+	}
+
+	if _, err := selectDevices(tableName, tagTableName, OrderBy{Column: "unlock_token"}); err == nil {
+		t.Error("expected error ordering by a column not in the allowlist")
+	}
+}
+
+func TestCountDevices(t *testing.T) {
+	db := setup(t)
+	ctx := context.Background()
+	resetDevices(t, db)
+
+	statuses := []device.DEPProfileStatus{device.EMPTY, device.EMPTY, device.ASSIGNED, device.PUSHED, device.EMPTY}
+	for i, status := range statuses {
+		id := fmt.Sprintf("count-%d", i)
+		dev := &device.Device{UUID: id, UDID: id, DEPProfileStatus: status}
+		if err := db.Save(ctx, dev); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer resetDevices(t, db)
+
+	total, err := db.CountDevices(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := total, len(statuses); have != want {
+		t.Errorf("total: have %d, want %d", have, want)
+	}
+
+	empty, err := db.CountDevices(ctx, DEPProfileStatus{Status: device.EMPTY}, Limit{N: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := empty, 3; have != want {
+		t.Errorf("empty: have %d, want %d", have, want)
+	}
+}
+
+func TestCountByModel(t *testing.T) {
+	db := setup(t)
+	ctx := context.Background()
+	resetDevices(t, db)
+	defer resetDevices(t, db)
+
+	models := []string{"iPhone10,3", "iPhone10,3", "iPhone10,3", "iPad8,1", "", ""}
+	for i, model := range models {
+		id := fmt.Sprintf("count-model-%d", i)
+		if err := db.Save(ctx, &device.Device{UUID: id, UDID: id, Model: model}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := db.db.ExecContext(ctx, `UPDATE devices SET model = NULL WHERE uuid = $1`, "count-model-5"); err != nil {
+		t.Fatal(err)
+	}
+
+	counts, err := db.CountByModel(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]int{"iPhone10,3": 3, "iPad8,1": 1, "": 2}
+	if !reflect.DeepEqual(counts, want) {
+		t.Errorf("have %v, want %v", counts, want)
+	}
+}
+
+func TestDEPAssignmentsByDay(t *testing.T) {
+	db := setup(t)
+	ctx := context.Background()
+	resetDevices(t, db)
+	defer resetDevices(t, db)
+
+	today := time.Now().UTC().Truncate(24 * time.Hour).Add(12 * time.Hour)
+	days := []time.Time{
+		today, today,
+		today.AddDate(0, 0, -3),
+		today.AddDate(0, 0, -10), today.AddDate(0, 0, -10), today.AddDate(0, 0, -10),
+		today.AddDate(0, 0, -60), // before since
+	}
+	for i := range days {
+		id := fmt.Sprintf("dep-day-%d", i)
+		if err := db.Save(ctx, &device.Device{UUID: id, SerialNumber: id, DEPProfileAssignedDate: &days[i]}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Save(ctx, &device.Device{UUID: "dep-day-never", SerialNumber: "dep-day-never"}); err != nil {
+		t.Fatal(err)
+	}
+
+	counts, err := db.DEPAssignmentsByDay(ctx, today.AddDate(0, -1, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]int{
+		today.Format("2006-01-02"):                    2,
+		today.AddDate(0, 0, -3).Format("2006-01-02"):  1,
+		today.AddDate(0, 0, -10).Format("2006-01-02"): 3,
+	}
+	if !reflect.DeepEqual(counts, want) {
+		t.Errorf("have %v, want %v", counts, want)
+	}
+}
+
+func TestFindDuplicateSerials(t *testing.T) {
+	db := setup(t)
+	ctx := context.Background()
+	resetDevices(t, db)
+	defer resetDevices(t, db)
+
+	// duplicates saved before the devices_serial_number_key index existed,
+	// recreated in a transaction which drops the index and is rolled back.
+	errRollback := errors.New("rollback")
+	err := db.WithTx(ctx, func(tx Store) error {
+		if _, err := tx.(*Postgres).conn().ExecContext(ctx, `DROP INDEX devices_serial_number_key`); err != nil {
+			return err
+		}
+		if err := tx.Save(ctx, &device.Device{UUID: "dup-1", SerialNumber: "C02DUP"}); err != nil {
+			return err
+		}
+		if err := tx.Save(ctx, &device.Device{UUID: "unique", SerialNumber: "C02UNIQUE"}); err != nil {
+			return err
+		}
+		// serial numbers saved before Save normalized them.
+		// and a serial whose tab is not trimmed, so it is not a duplicate.
+		for uuid, serial := range map[string]string{"dup-2": "c02dup", "dup-3": " C02Dup ", "tab": "C02DUP\t"} {
+			if _, err := tx.(*Postgres).conn().ExecContext(ctx, `INSERT INTO devices (uuid, serial_number) VALUES ($1, $2)`, uuid, serial); err != nil {
+				return err
+			}
+		}
+
+		duplicates, err := tx.FindDuplicateSerials(ctx)
+		if err != nil {
+			return err
+		}
+		want := map[string][]string{"C02DUP": {"dup-1", "dup-2", "dup-3"}}
+		if !reflect.DeepEqual(duplicates, want) {
+			t.Errorf("have %v, want %v", duplicates, want)
+		}
+		return errRollback
+	})
+	if err != errRollback {
+		t.Fatal(err)
+	}
+}
+
+func TestNormalizeSerial(t *testing.T) {
+	// the same normalization as serialKey, upper(btrim(serial_number)).
+	for serial, want := range map[string]string{
+		"C02ABC":       "C02ABC",
+		" c02abc  ":    "C02ABC",
+		"C02ABC\t":     "C02ABC\t",
+		"\u00a0C02ABC": "\u00a0C02ABC",
+	} {
+		if have := normalizeSerial(serial); have != want {
+			t.Errorf("normalizeSerial(%q): have %q, want %q", serial, have, want)
+		}
+	}
+}
+
+func TestSerialNumberUnique(t *testing.T) {
+	db := setup(t)
+	ctx := context.Background()
+	resetDevices(t, db)
+	defer resetDevices(t, db)
+
+	if err := db.Save(ctx, &device.Device{UUID: "serial-1", SerialNumber: "C02CASE"}); err != nil {
+		t.Fatal(err)
+	}
+	// a caller bypassing the normalization of Save.
+	_, err := db.db.ExecContext(ctx, `INSERT INTO devices (uuid, serial_number) VALUES ('serial-2', ' c02case')`)
+	if err == nil {
+		t.Error("saved a differently cased copy of a serial number")
+	}
+	err = db.Save(ctx, &device.Device{UUID: "serial-3", SerialNumber: "c02Case"})
+	if err == nil || !strings.Contains(err.Error(), `serial number "c02Case" of device serial-3 is already saved`) {
+		t.Errorf("Save: have %v, want a serial number conflict", err)
+	}
+
+	// lookups normalize the serial the way the index does.
+	if found, err := db.DeviceBySerial(ctx, " c02case"); err != nil || found.UUID != "serial-1" {
+		t.Errorf("DeviceBySerial: have %v, %v, want serial-1", found, err)
+	}
+	if found, err := db.Devices(ctx, SerialNumber{SerialNumber: "c02Case "}); err != nil || len(found) != 1 {
+		t.Errorf("SerialNumber filter: have %v, %v, want serial-1", found, err)
+	}
+
+	// the serial of a soft deleted device can be saved again.
+	if err := db.DeleteDevice(ctx, "serial-1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Save(ctx, &device.Device{UUID: "serial-3", SerialNumber: "C02CASE"}); err != nil {
+		t.Errorf("saving the serial of a deleted device: %v", err)
+	}
+}
+
+func TestDistinctValues(t *testing.T) {
+	db := setup(t)
+	ctx := context.Background()
+	resetDevices(t, db)
+	defer resetDevices(t, db)
+
+	for i, color := range []string{"silver", "space gray", "silver", "gold", "space gray"} {
+		id := fmt.Sprintf("distinct-%d", i)
+		if err := db.Save(ctx, &device.Device{UUID: id, UDID: id, Color: color}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := db.db.ExecContext(ctx, `UPDATE devices SET color = NULL WHERE uuid = $1`, "distinct-3"); err != nil {
+		t.Fatal(err)
+	}
+
+	colors, err := db.DistinctValues(ctx, "color")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := strings.Join(colors, ","), "silver,space gray"; have != want {
+		t.Errorf("have %s, want %s", have, want)
+	}
+}
+
+func TestDistinctValuesInvalidColumn(t *testing.T) {
+	db := lazySetup(t)
+	for _, column := range []string{"unlock_token", "model; DROP TABLE devices", ""} {
+		if _, err := db.DistinctValues(context.Background(), column); err == nil {
+			t.Errorf("expected an error for column %q", column)
+		}
+	}
+}
+
+func TestDevicesDEPProfileStatusFilter(t *testing.T) {
+	db := setup(t)
+	ctx := context.Background()
+	resetDevices(t, db)
+
+	statuses := []device.DEPProfileStatus{device.EMPTY, device.ASSIGNED, device.PUSHED, device.ASSIGNED}
+	for i, status := range statuses {
+		id := fmt.Sprintf("dep-status-%d", i)
+		dev := &device.Device{UUID: id, UDID: id, SerialNumber: id, DEPProfileStatus: status}
+		if err := db.Save(ctx, dev); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer resetDevices(t, db)
+
+	assigned, err := db.Devices(ctx, DEPProfileStatus{Status: device.ASSIGNED})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := len(assigned), 2; have != want {
+		t.Errorf("have %d devices, want %d", have, want)
+	}
+
+	// compose with another filter.
+	assigned, err = db.Devices(ctx, DEPProfileStatus{Status: device.ASSIGNED}, SerialNumber{SerialNumber: "dep-status-3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := len(assigned), 1; have != want {
+		t.Errorf("have %d devices, want %d", have, want)
+	}
+
+	notAssigned, err := db.Devices(ctx, Not{DEPProfileStatus{Status: device.ASSIGNED}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, dev := range notAssigned {
+		ids = append(ids, dev.UUID)
+	}
+	if have, want := strings.Join(ids, ","), "dep-status-0,dep-status-2"; have != want {
+		t.Errorf("not assigned: have %s, want %s", have, want)
+	}
+}
+
+func TestAssignWorkflow(t *testing.T) {
+	db := setup(t)
+	ctx := context.Background()
+	resetDevices(t, db)
+	defer resetDevices(t, db)
+
+	for _, id := range []string{"workflow-1", "workflow-2", "workflow-3"} {
+		if err := db.Save(ctx, &device.Device{UUID: id, UDID: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	n, err := db.AssignWorkflow(ctx, []string{"workflow-1", "workflow-3", "does-not-exist"}, "wf-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := n, 2; have != want {
+		t.Errorf("rows affected: have %d, want %d", have, want)
+	}
+
+	found, err := db.Devices(ctx, WorkflowUUID{UUID: "wf-a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := len(found), 2; have != want {
+		t.Fatalf("have %d devices, want %d", have, want)
+	}
+	if have, want := found[0].UUID+","+found[1].UUID, "workflow-1,workflow-3"; have != want {
+		t.Errorf("have %s, want %s", have, want)
+	}
+
+	if n, err := db.AssignWorkflow(ctx, nil, "wf-a"); err != nil || n != 0 {
+		t.Errorf("empty assignment: have (%d, %v), want (0, nil)", n, err)
+	}
+}
+
+func TestDevicesNoWorkflow(t *testing.T) {
+	db := setup(t)
+	ctx := context.Background()
+	resetDevices(t, db)
+	defer resetDevices(t, db)
+
+	for _, id := range []string{"onboard-1", "onboard-2", "onboard-3"} {
+		if err := db.Save(ctx, &device.Device{UUID: id, UDID: id, Enrolled: true}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := db.AssignWorkflow(ctx, []string{"onboard-2"}, "wf-a"); err != nil {
+		t.Fatal(err)
+	}
+	// a row written before workflow_uuid had a default.
+	if _, err := db.db.ExecContext(ctx, `UPDATE devices SET workflow_uuid = NULL WHERE uuid = 'onboard-3'`); err != nil {
+		t.Fatal(err)
+	}
+
+	unassigned := func() string {
+		t.Helper()
+		found, err := db.Devices(ctx, NoWorkflow{}, Enrolled{Enrolled: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []string
+		for _, dev := range found {
+			ids = append(ids, dev.UUID)
+		}
+		return strings.Join(ids, ",")
+	}
+
+	if have, want := unassigned(), "onboard-1,onboard-3"; have != want {
+		t.Errorf("have %s, want %s", have, want)
+	}
+	if _, err := db.AssignWorkflow(ctx, []string{"onboard-1"}, "wf-a"); err != nil {
+		t.Fatal(err)
+	}
+	if have, want := unassigned(), "onboard-3"; have != want {
+		t.Errorf("after assigning a workflow: have %s, want %s", have, want)
+	}
+}
+
+func TestRetargetWorkflow(t *testing.T) {
+	db := setup(t)
+	ctx := context.Background()
+	resetDevices(t, db)
+	defer resetDevices(t, db)
+
+	ids := []string{"retarget-1", "retarget-2", "retarget-3", "retarget-other"}
+	for _, id := range ids {
+		if err := db.Save(ctx, &device.Device{UUID: id, UDID: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := db.AssignWorkflow(ctx, ids[:3], "wf-old"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.AssignWorkflow(ctx, ids[3:], "wf-other"); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := db.RetargetWorkflow(ctx, "wf-old", "wf-new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := n, 3; have != want {
+		t.Errorf("have %d devices retargeted, want %d", have, want)
+	}
+
+	for workflow, want := range map[string]int{"wf-old": 0, "wf-new": 3, "wf-other": 1} {
+		found, err := db.Devices(ctx, WorkflowUUID{UUID: workflow})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if have := len(found); have != want {
+			t.Errorf("%s: have %d devices, want %d", workflow, have, want)
+		}
+	}
+
+	if n, err := db.RetargetWorkflow(ctx, "wf-old", "wf-new"); err != nil || n != 0 {
+		t.Errorf("no matching devices: have (%d, %v), want (0, nil)", n, err)
+	}
+}
+
+func TestClearDEPProfile(t *testing.T) {
+	db := setup(t)
+	ctx := context.Background()
+	resetDevices(t, db)
+	defer resetDevices(t, db)
+
+	assigned := time.Now().UTC().Truncate(time.Second)
+	dev := device.Device{
+		UUID:                   "dep-clear",
+		SerialNumber:           "C02DEPCLEAR",
+		Model:                  "MacBookPro15,1",
+		Color:                  "space gray",
+		DEPProfileStatus:       device.ASSIGNED,
+		DEPProfileUUID:         "profile-1",
+		DEPProfileAssignTime:   &assigned,
+		DEPProfilePushTime:     &assigned,
+		DEPProfileAssignedDate: &assigned,
+		DEPProfileAssignedBy:   "admin@example.com",
+	}
+	if err := db.Save(ctx, &dev); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.ClearDEPProfile(ctx, dev.SerialNumber); err != nil {
+		t.Fatal(err)
+	}
+
+	found, err := db.DeviceBySerial(ctx, dev.SerialNumber)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found.DEPProfileUUID != "" || found.DEPProfileStatus != "" {
+		t.Errorf("profile not cleared: have uuid %q, status %q", found.DEPProfileUUID, found.DEPProfileStatus)
+	}
+	if found.DEPProfileAssignTime != nil || found.DEPProfilePushTime != nil {
+		t.Errorf("profile times not reset: have %v, %v", found.DEPProfileAssignTime, found.DEPProfilePushTime)
+	}
+	if found.Model != dev.Model || found.Color != dev.Color || found.DEPProfileAssignedBy != dev.DEPProfileAssignedBy {
+		t.Errorf("clearing the profile changed other fields: have %+v", found)
+	}
+
+	if err := db.ClearDEPProfile(ctx, "C02MISSING"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("unknown serial: have %v, want ErrNotFound", err)
+	}
+}
+
+func TestResetEnrollment(t *testing.T) {
+	db := setup(t)
+	ctx := context.Background()
+	resetDevices(t, db)
+	defer resetDevices(t, db)
+
+	assigned := time.Now().UTC().Truncate(time.Second)
+	dev := device.Device{
+		UUID:                   "reset-1",
+		UDID:                   "UDID-reset-1",
+		SerialNumber:           "C02RESET",
+		Token:                  "push-token",
+		PushMagic:              "push-magic",
+		UnlockToken:            "unlock-token",
+		Enrolled:               true,
+		Model:                  "iPad8,1",
+		Color:                  "space gray",
+		AssetTag:               "IT-0042",
+		DEPProfileStatus:       device.PUSHED,
+		DEPProfileUUID:         "profile-1",
+		DEPProfileAssignedDate: &assigned,
+		DEPProfileAssignedBy:   "admin@example.com",
+	}
+	if err := db.Save(ctx, &dev); err != nil {
+		t.Fatal(err)
+	}
+	for _, stmt := range []string{
+		`DELETE FROM push_info WHERE udid IN ('UDID-reset-1', 'UDID-reset-other')`,
+		`INSERT INTO push_info (udid, token, push_magic, mdm_topic) VALUES
+			('UDID-reset-1', 'push-token', 'push-magic', 'com.apple.mgmt.External.1'),
+			('UDID-reset-other', 'other-token', 'other-magic', 'com.apple.mgmt.External.1')`,
+	} {
+		if _, err := db.db.ExecContext(ctx, stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer db.db.ExecContext(ctx, `DELETE FROM push_info WHERE udid IN ('UDID-reset-1', 'UDID-reset-other')`)
+
+	if err := db.ResetEnrollment(ctx, "c02reset"); err != nil {
+		t.Fatal(err)
+	}
+
+	found, err := db.DeviceBySerial(ctx, dev.SerialNumber)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found.UDID != "" || found.Token != "" || found.PushMagic != "" || found.UnlockToken != "" || found.Enrolled {
+		t.Errorf("MDM fields not cleared: have %+v", device.RedactDevice(*found))
+	}
+	if !found.AwaitingConfiguration {
+		t.Error("reset device is not awaiting configuration")
+	}
+	if found.DEPProfileStatus != dev.DEPProfileStatus || found.DEPProfileUUID != dev.DEPProfileUUID ||
+		found.DEPProfileAssignedBy != dev.DEPProfileAssignedBy || found.DEPProfileAssignedDate == nil ||
+		found.Model != dev.Model || found.Color != dev.Color || found.AssetTag != dev.AssetTag {
+		t.Errorf("reset changed the DEP identity: have %+v", found)
+	}
+	if _, err := db.DeviceByUDID(ctx, dev.UDID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("lookup by the old udid: have %v, want ErrNotFound", err)
+	}
+
+	var emptyUDID bool
+	if err := db.db.GetContext(ctx, &emptyUDID, `SELECT udid IS NOT NULL AND udid = '' FROM devices WHERE uuid = $1`, dev.UUID); err != nil {
+		t.Fatal(err)
+	}
+	if !emptyUDID {
+		t.Error("reset udid is not stored as the column default ''")
+	}
+
+	var udids []string
+	if err := db.db.SelectContext(ctx, &udids, `SELECT udid FROM push_info WHERE udid IN ('UDID-reset-1', 'UDID-reset-other') ORDER BY udid`); err != nil {
+		t.Fatal(err)
+	}
+	if have, want := fmt.Sprint(udids), "[UDID-reset-other]"; have != want {
+		t.Errorf("push info after reset: have %s, want %s", have, want)
+	}
+
+	if err := db.ResetEnrollment(ctx, "C02MISSING"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("unknown serial: have %v, want ErrNotFound", err)
+	}
+}
+
+func TestSaveMissingDEPProfileTimes(t *testing.T) {
+	db := setup(t)
+	ctx := context.Background()
+	resetDevices(t, db)
+	defer resetDevices(t, db)
+
+	assigned := time.Now().UTC().Truncate(time.Second)
+	zero := time.Time{}
+	dev := device.Device{
+		UUID:                   "dep-no-push",
+		SerialNumber:           "C02DEPNOPUSH",
+		DEPProfileStatus:       device.ASSIGNED,
+		DEPProfileUUID:         "profile-1",
+		DEPProfileAssignTime:   &assigned,
+		DEPProfileAssignedDate: &zero,
+	}
+	if err := db.Save(ctx, &dev); err != nil {
+		t.Fatal(err)
+	}
+
+	found, err := db.DeviceBySerial(ctx, dev.SerialNumber)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found.DEPProfilePushTime != nil {
+		t.Errorf("missing push time read back as %v, want nil", found.DEPProfilePushTime)
+	}
+	if found.DEPProfileAssignedDate != nil {
+		t.Errorf("zero assigned date read back as %v, want nil", found.DEPProfileAssignedDate)
+	}
+	if found.DEPProfileAssignTime == nil || !found.DEPProfileAssignTime.Equal(assigned) {
+		t.Errorf("have assign time %v, want %v", found.DEPProfileAssignTime, assigned)
+	}
+
+	var nulls int
+	if err := db.db.GetContext(ctx, &nulls,
+		`SELECT count(*) FROM devices WHERE uuid = $1 AND dep_profile_push_time IS NULL AND dep_profile_assigned_date IS NULL`,
+		dev.UUID,
+	); err != nil {
+		t.Fatal(err)
+	}
+	if nulls != 1 {
+		t.Error("missing DEP profile times were not stored as NULL")
+	}
+}
+
+func TestDevicesByDEPProfile(t *testing.T) {
+	db := setup(t)
+	ctx := context.Background()
+	resetDevices(t, db)
+	defer resetDevices(t, db)
+
+	profiles := map[string]string{
+		"dep-1": "profile-a",
+		"dep-2": "profile-b",
+		"dep-3": "profile-a",
+		"dep-4": "",
+	}
+	for id, profile := range profiles {
+		if err := db.Save(ctx, &device.Device{UUID: id, SerialNumber: id, DEPProfileUUID: profile}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	byProfile, err := db.DevicesByDEPProfile(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	grouped := make(map[string]string)
+	for profile, devices := range byProfile {
+		var ids []string
+		for _, dev := range devices {
+			ids = append(ids, dev.UUID)
+		}
+		grouped[profile] = strings.Join(ids, ",")
+	}
+	want := map[string]string{"profile-a": "dep-1,dep-3", "profile-b": "dep-2"}
+	if !reflect.DeepEqual(grouped, want) {
+		t.Errorf("have %v, want %v", grouped, want)
+	}
+}
+
+func TestDEPAssignmentHistory(t *testing.T) {
+	db := setup(t)
+	ctx := context.Background()
+	resetDevices(t, db)
+	defer resetDevices(t, db)
+
+	dev := &device.Device{UUID: "dep-history", SerialNumber: "C02HISTORY"}
+	if err := db.Save(ctx, dev); err != nil {
+		t.Fatal(err)
+	}
+	for _, profile := range []string{"profile-1", "profile-2"} {
+		dev.DEPProfileUUID = profile
+		dev.DEPProfileAssignedBy = "admin@example.com"
+		if err := db.Save(ctx, dev); err != nil {
+			t.Fatal(err)
+		}
+		// saving the same profile again is not a new assignment.
+		if err := db.Save(ctx, dev); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	history, err := db.DEPAssignmentHistory(ctx, "dep-history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := len(history), 2; have != want {
+		t.Fatalf("have %d history entries, want %d: %+v", have, want, history)
+	}
+	for i, want := range []string{"profile-2", "profile-1"} {
+		if have := history[i].ProfileUUID; have != want {
+			t.Errorf("entry %d: have profile %s, want %s", i, have, want)
+		}
+		if have, want := history[i].AssignedBy, "admin@example.com"; have != want {
+			t.Errorf("entry %d: have assigned by %s, want %s", i, have, want)
+		}
+	}
+	if history[0].AssignedAt.Before(history[1].AssignedAt) {
+		t.Errorf("history not newest first: %v before %v", history[0].AssignedAt, history[1].AssignedAt)
+	}
+}
+
+func TestRecordDEPAssignResult(t *testing.T) {
+	db := setup(t)
+	ctx := context.Background()
+	resetDevices(t, db)
+	defer resetDevices(t, db)
+
+	if err := db.Save(ctx, &device.Device{UUID: "dep-assign", SerialNumber: "C02DEPASSIGN"}); err != nil {
+		t.Fatal(err)
+	}
+
+	assignResult := func() (lastErr string, attempts int) {
+		t.Helper()
+		row := db.db.QueryRowxContext(ctx,
+			`SELECT dep_assign_error, dep_assign_attempts FROM devices WHERE uuid = $1`, "dep-assign")
+		if err := row.Scan(&lastErr, &attempts); err != nil {
+			t.Fatal(err)
+		}
+		return lastErr, attempts
+	}
+
+	if err := db.RecordDEPAssignResult(ctx, "C02DEPASSIGN", errors.New("NOT_ACCESSIBLE")); err != nil {
+		t.Fatal(err)
+	}
+	if lastErr, attempts := assignResult(); lastErr != "NOT_ACCESSIBLE" || attempts != 1 {
+		t.Errorf("after failure: have (%q, %d), want (%q, 1)", lastErr, attempts, "NOT_ACCESSIBLE")
+	}
+	failed, err := db.Devices(ctx, DEPAssignFailed{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := len(failed), 1; have != want {
+		t.Fatalf("have %d failed devices, want %d", have, want)
+	}
+
+	if err := db.RecordDEPAssignResult(ctx, "C02DEPASSIGN", nil); err != nil {
+		t.Fatal(err)
+	}
+	if lastErr, attempts := assignResult(); lastErr != "" || attempts != 2 {
+		t.Errorf("after success: have (%q, %d), want (\"\", 2)", lastErr, attempts)
+	}
+	failed, err = db.Devices(ctx, DEPAssignFailed{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := len(failed), 0; have != want {
+		t.Errorf("have %d failed devices, want %d", have, want)
+	}
+
+	if err := db.RecordDEPAssignResult(ctx, "C02MISSING", nil); !errors.Is(err, ErrNotFound) {
+		t.Errorf("unknown serial: have %v, want ErrNotFound", err)
+	}
+}
+
+func TestDevicesEnrolledFilter(t *testing.T) {
+	db := setup(t)
+	ctx := context.Background()
+	resetDevices(t, db)
+	defer resetDevices(t, db)
+
+	devs := []*device.Device{
+		{UUID: "enrolled-1", UDID: "enrolled-1", Enrolled: true},
+		{UUID: "enrolled-2", UDID: "enrolled-2", Enrolled: true},
+		{UUID: "unenrolled-1", UDID: "unenrolled-1"},
+	}
+	for _, dev := range devs {
+		if err := db.Save(ctx, dev); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	enrolled, err := db.Devices(ctx, Enrolled{Enrolled: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := len(enrolled), 2; have != want {
+		t.Errorf("enrolled: have %d devices, want %d", have, want)
+	}
+
+	unenrolled, err := db.Devices(ctx, Enrolled{Enrolled: false})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := len(unenrolled), 1; have != want {
+		t.Fatalf("unenrolled: have %d devices, want %d", have, want)
+	}
+	if have, want := unenrolled[0].UUID, "unenrolled-1"; have != want {
+		t.Errorf("have %s, want %s", have, want)
+	}
+}
+
+func TestRecordPush(t *testing.T) {
+	db := setup(t)
+	ctx := context.Background()
+	resetDevices(t, db)
+	defer resetDevices(t, db)
+
+	for _, id := range []string{"pushed", "never-pushed"} {
+		if err := db.Save(ctx, &device.Device{UUID: id, UDID: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	lastPushError := func() string {
+		t.Helper()
+		var lastErr string
+		if err := db.db.GetContext(ctx, &lastErr, `SELECT last_push_error FROM devices WHERE uuid = 'pushed'`); err != nil {
+			t.Fatal(err)
+		}
+		return lastErr
+	}
+
+	if err := db.RecordPush(ctx, "pushed", errors.New("BadDeviceToken")); err != nil {
+		t.Fatal(err)
+	}
+	if have, want := lastPushError(), "BadDeviceToken"; have != want {
+		t.Errorf("after failure: have %q, want %q", have, want)
+	}
+	if err := db.RecordPush(ctx, "pushed", nil); err != nil {
+		t.Fatal(err)
+	}
+	if have := lastPushError(); have != "" {
+		t.Errorf("after success: have %q, want the error cleared", have)
+	}
+
+	due, err := db.Devices(ctx, PushedBefore{Time: time.Now().Add(-time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := len(due), 1; have != want {
+		t.Fatalf("have %d devices due, want %d", have, want)
+	}
+	if have, want := due[0].UUID, "never-pushed"; have != want {
+		t.Errorf("have %s, want %s", have, want)
+	}
+
+	due, err = db.Devices(ctx, PushedBefore{Time: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := len(due), 2; have != want {
+		t.Errorf("have %d devices due, want %d", have, want)
+	}
+
+	if err := db.RecordPush(ctx, "does-not-exist", nil); !errors.Is(err, ErrNotFound) {
+		t.Errorf("unknown udid: have %v, want ErrNotFound", err)
+	}
+}
+
+func TestSetAwaitingConfiguration(t *testing.T) {
+	db := setup(t)
+	ctx := context.Background()
+	resetDevices(t, db)
+	defer resetDevices(t, db)
+
+	for _, id := range []string{"setup-1", "setup-2"} {
+		if err := db.Save(ctx, &device.Device{UUID: id, UDID: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	awaiting := func() []string {
+		t.Helper()
+		found, err := db.Devices(ctx, AwaitingConfiguration{Awaiting: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []string
+		for _, dev := range found {
+			ids = append(ids, dev.UDID)
+		}
+		return ids
+	}
+
+	if err := db.SetAwaitingConfiguration(ctx, "setup-2", true); err != nil {
+		t.Fatal(err)
+	}
+	if have, want := strings.Join(awaiting(), ","), "setup-2"; have != want {
+		t.Errorf("have %s, want %s", have, want)
+	}
+
+	if err := db.SetAwaitingConfiguration(ctx, "setup-2", false); err != nil {
+		t.Fatal(err)
+	}
+	if have := awaiting(); len(have) != 0 {
+		t.Errorf("have %v awaiting configuration after clearing, want none", have)
+	}
+
+	if err := db.SetAwaitingConfiguration(ctx, "does-not-exist", true); !errors.Is(err, ErrNotFound) {
+		t.Errorf("unknown udid: have %v, want ErrNotFound", err)
+	}
+}
+
+func TestUpdateDEPStatusBySerials(t *testing.T) {
+	db := setup(t)
+	ctx := context.Background()
+	resetDevices(t, db)
+	defer resetDevices(t, db)
+
+	for _, serial := range []string{"BATCH1", "BATCH2", "BATCH3"} {
+		dev := &device.Device{UUID: serial, SerialNumber: serial, DEPProfileStatus: device.EMPTY}
+		if err := db.Save(ctx, dev); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	n, err := db.UpdateDEPStatusBySerials(ctx, device.ASSIGNED, []string{"batch1", "BATCH3", "NOT-A-DEVICE"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := n, 2; have != want {
+		t.Errorf("have %d devices updated, want %d", have, want)
+	}
+
+	want := map[string]device.DEPProfileStatus{
+		"BATCH1": device.ASSIGNED,
+		"BATCH2": device.EMPTY,
+		"BATCH3": device.ASSIGNED,
+	}
+	for serial, status := range want {
+		dev, err := db.DeviceBySerial(ctx, serial)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if have := dev.DEPProfileStatus; have != status {
+			t.Errorf("%s: have %s, want %s", serial, have, status)
+		}
+	}
+
+	if n, err := db.UpdateDEPStatusBySerials(ctx, device.ASSIGNED, nil); err != nil || n != 0 {
+		t.Errorf("empty serials: have %d, %v, want 0, nil", n, err)
+	}
+}
+
+func TestDeviceTags(t *testing.T) {
+	db := setup(t)
+	ctx := context.Background()
+	resetDevices(t, db)
+	defer resetDevices(t, db)
+
+	for _, id := range []string{"tagged-1", "tagged-2", "untagged"} {
+		if err := db.Save(ctx, &device.Device{UUID: id, UDID: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.AddTags(ctx, "tagged-1", "finance", "loaner"); err != nil {
+		t.Fatal(err)
+	}
+	// adding a tag twice is a no-op.
+	if err := db.AddTags(ctx, "tagged-1", "finance", "finance"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddTags(ctx, "tagged-2", "finance"); err != nil {
+		t.Fatal(err)
+	}
+
+	tagged := func(tag string) string {
+		t.Helper()
+		found, err := db.Devices(ctx, HasTag{Tag: tag})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []string
+		for _, dev := range found {
+			ids = append(ids, dev.UUID)
+		}
+		return strings.Join(ids, ",")
+	}
+	if have, want := tagged("finance"), "tagged-1,tagged-2"; have != want {
+		t.Errorf("finance: have %q, want %q", have, want)
+	}
+	if have, want := tagged("loaner"), "tagged-1"; have != want {
+		t.Errorf("loaner: have %q, want %q", have, want)
+	}
+
+	var count int
+	if err := db.db.Get(&count, `SELECT COUNT(*) FROM device_tags WHERE device_uuid = $1`, "tagged-1"); err != nil {
+		t.Fatal(err)
+	}
+	if have, want := count, 2; have != want {
+		t.Errorf("have %d tags on tagged-1, want %d", have, want)
+	}
+
+	if err := db.RemoveTags(ctx, "tagged-1", "finance", "exec"); err != nil {
+		t.Fatal(err)
+	}
+	if have, want := tagged("finance"), "tagged-2"; have != want {
+		t.Errorf("finance after removal: have %q, want %q", have, want)
+	}
+	if have, want := tagged("loaner"), "tagged-1"; have != want {
+		t.Errorf("loaner after removal: have %q, want %q", have, want)
+	}
+}
+
+func TestPushableDevices(t *testing.T) {
+	db := setup(t)
+	ctx := context.Background()
+	resetDevices(t, db)
+	defer resetDevices(t, db)
+
+	devs := []*device.Device{
+		{UUID: "pushable", UDID: "pushable", Enrolled: true, Token: "tok", PushMagic: "magic"},
+		{UUID: "no-token", UDID: "no-token", Enrolled: true, PushMagic: "magic"},
+		{UUID: "no-magic", UDID: "no-magic", Enrolled: true, Token: "tok"},
+		{UUID: "unenrolled", UDID: "unenrolled", Token: "tok", PushMagic: "magic"},
+	}
+	for _, dev := range devs {
+		if err := db.Save(ctx, dev); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	found, err := db.PushableDevices(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := len(found), 1; have != want {
+		t.Fatalf("have %d devices, want %d", have, want)
+	}
+	if have, want := found[0].UUID, "pushable"; have != want {
+		t.Errorf("have %s, want %s", have, want)
+	}
+	if found[0].Token == "" || found[0].PushMagic == "" {
+		t.Errorf("push credentials not populated: %+v", found[0])
+	}
+
+	missing, err := db.Devices(ctx, MissingPushCredentials{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, dev := range missing {
+		ids = append(ids, dev.UUID)
+	}
+	if have, want := strings.Join(ids, ","), "no-magic,no-token"; have != want {
+		t.Errorf("missing push credentials: have %s, want %s", have, want)
+	}
+}
+
+func TestDevicesColorFilter(t *testing.T) {
+	db := setup(t)
+	ctx := context.Background()
+	resetDevices(t, db)
+	defer resetDevices(t, db)
+
+	colors := map[string]string{
+		"ipad-1": "Space Gray",
+		"ipad-2": "Silver",
+		"ipad-3": "Space Gray",
+		"ipad-4": "",
+	}
+	for id, color := range colors {
+		if err := db.Save(ctx, &device.Device{UUID: id, SerialNumber: id, Model: "iPad", Color: color}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	found, err := db.Devices(ctx, Color{Color: "Space Gray"}, ModelLike{Pattern: "iPad%"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, dev := range found {
+		ids = append(ids, dev.UUID)
+		if have, want := dev.Color, "Space Gray"; have != want {
+			t.Errorf("%s: have color %q, want %q", dev.UUID, have, want)
+		}
+	}
+	if have, want := strings.Join(ids, ","), "ipad-1,ipad-3"; have != want {
+		t.Errorf("have %s, want %s", have, want)
+	}
+}
+
+func TestClaimDevicesForPush(t *testing.T) {
+	db := setup(t)
+	ctx := context.Background()
+	resetDevices(t, db)
+	defer resetDevices(t, db)
+
+	const devices = 20
+	for i := 0; i < devices; i++ {
+		id := fmt.Sprintf("claim-%02d", i)
+		if err := db.Save(ctx, &device.Device{UUID: id, UDID: id, Enrolled: true, Token: "tok", PushMagic: "magic"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Save(ctx, &device.Device{UUID: "claim-unenrolled", UDID: "claim-unenrolled", Token: "tok", PushMagic: "magic"}); err != nil {
+		t.Fatal(err)
+	}
+
+	const workers = 4
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		claimed = map[string]int{}
+	)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			batch, err := db.ClaimDevicesForPush(ctx, devices/workers)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			for _, dev := range batch {
+				claimed[dev.UUID]++
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(claimed) == 0 {
+		t.Fatal("no devices claimed")
+	}
+	for uuid, n := range claimed {
+		if n > 1 {
+			t.Errorf("device %s claimed by %d workers", uuid, n)
+		}
+	}
+	if _, ok := claimed["claim-unenrolled"]; ok {
+		t.Error("claimed a device which cannot be pushed")
+	}
+
+	// the next claim starts with the devices claimed least recently, or not at all.
+	if len(claimed) < devices {
+		next, err := db.ClaimDevicesForPush(ctx, devices-len(claimed))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, dev := range next {
+			if _, ok := claimed[dev.UUID]; ok {
+				t.Errorf("reclaimed %s before unclaimed devices", dev.UUID)
+			}
+		}
+	}
+}
+
+func TestDevicesModelLike(t *testing.T) {
+	db := setup(t)
+	ctx := context.Background()
+	resetDevices(t, db)
+	defer resetDevices(t, db)
+
+	for i, model := range []string{"iPhone10,3", "iphone12,1", "iPad8,1", "MacBookPro15,1"} {
+		id := fmt.Sprintf("model-%d", i)
+		if err := db.Save(ctx, &device.Device{UUID: id, UDID: id, Model: model}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	found, err := db.Devices(ctx, ModelLike{Pattern: "iPhone%"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := len(found), 2; have != want {
+		t.Errorf("have %d devices, want %d", have, want)
+	}
+
+	found, err = db.Devices(ctx, sq.Or{ModelLike{Pattern: "iPhone%"}, ModelLike{Pattern: "iPad%"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := len(found), 3; have != want {
+		t.Errorf("have %d devices, want %d", have, want)
+	}
+
+	found, err = db.Devices(ctx, ModelLike{Pattern: "'; DROP TABLE devices;--"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := len(found), 0; have != want {
+		t.Errorf("have %d devices, want %d", have, want)
+	}
+}
+
+func TestDevicesBuildVersion(t *testing.T) {
+	db := setup(t)
+	ctx := context.Background()
+	resetDevices(t, db)
+	defer resetDevices(t, db)
+
+	for i, build := range []string{"17D50", "17D50", "17D5012a", "17E255", "16G77", ""} {
+		id := fmt.Sprintf("build-%d", i)
+		if err := db.Save(ctx, &device.Device{UUID: id, UDID: id, BuildVersion: build}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		filter sq.Sqlizer
+		want   []string
+	}{
+		{BuildVersion{Build: "17D50"}, []string{"build-0", "build-1"}},
+		{BuildVersion{Build: "17D"}, nil},
+		{BuildVersionLike{Pattern: "17D"}, []string{"build-0", "build-1", "build-2"}},
+		{BuildVersionLike{Pattern: "17"}, []string{"build-0", "build-1", "build-2", "build-3"}},
+		{BuildVersionLike{Pattern: "17_"}, nil},
+	}
+	for _, tt := range tests {
+		found, err := db.Devices(ctx, tt.filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var have []string
+		for _, dev := range found {
+			have = append(have, dev.UUID)
+			if dev.BuildVersion == "" {
+				t.Errorf("%#v: build_version not selected for %s", tt.filter, dev.UUID)
+			}
+		}
+		if !reflect.DeepEqual(have, tt.want) {
+			t.Errorf("%#v: have %v, want %v", tt.filter, have, tt.want)
+		}
+	}
+}
+
+func TestSelectDevicesBuildVersionLikeEscapes(t *testing.T) {
+	stmt, err := selectDevices(tableName, tagTableName, BuildVersionLike{Pattern: "17_%"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	query, args, err := stmt.ToSql()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(query, "WHERE build_version LIKE $1") {
+		t.Errorf("prefix not parameterized: %s", query)
+	}
+	if have, want := fmt.Sprint(args), `[17\_\%%]`; have != want {
+		t.Errorf("have args %s, want %s", have, want)
+	}
+}
+
+func TestCustomAttributes(t *testing.T) {
+	db := setup(t)
+	ctx := context.Background()
+	resetDevices(t, db)
+	defer resetDevices(t, db)
+
+	for _, id := range []string{"attr-1", "attr-2", "attr-3"} {
+		if err := db.Save(ctx, &device.Device{UUID: id, UDID: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	attributes, err := db.GetAttributes(ctx, "attr-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(attributes) != 0 {
+		t.Errorf("new device has attributes %v", attributes)
+	}
+
+	for _, attr := range []struct {
+		uuid, key string
+		value     interface{}
+	}{
+		{"attr-1", "department", "sales"},
+		{"attr-1", "cost_center", 1200},
+		{"attr-1", "loaner", true},
+		{"attr-1", "department", "finance"}, // replaces sales
+		{"attr-2", "department", "finance"},
+		{"attr-3", "department", "it"},
+	} {
+		if err := db.SetAttribute(ctx, attr.uuid, attr.key, attr.value); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	attributes, err = db.GetAttributes(ctx, "attr-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{"department": "finance", "cost_center": float64(1200), "loaner": true}
+	if !reflect.DeepEqual(attributes, want) {
+		t.Errorf("have %v, want %v", attributes, want)
+	}
+
+	found, err := db.Devices(ctx, AttributeEquals{Key: "department", Value: "finance"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := deviceUUIDs(found), []string{"attr-1", "attr-2"}; !reflect.DeepEqual(have, want) {
+		t.Errorf("have %v, want %v", have, want)
+	}
+	found, err = db.Devices(ctx, AttributeEquals{Key: "cost_center", Value: "1200"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := deviceUUIDs(found), []string{"attr-1"}; !reflect.DeepEqual(have, want) {
+		t.Errorf("have %v, want %v", have, want)
+	}
+
+	// saving the device does not touch its attributes.
+	if err := db.Save(ctx, &device.Device{UUID: "attr-1", UDID: "attr-1", Model: "iPad8,1"}); err != nil {
+		t.Fatal(err)
+	}
+	if attributes, err := db.GetAttributes(ctx, "attr-1"); err != nil || len(attributes) != 3 {
+		t.Errorf("attributes after save: have %v, %v", attributes, err)
+	}
+
+	if err := db.SetAttribute(ctx, "does-not-exist", "department", "it"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("unknown device: have %v, want ErrNotFound", err)
+	}
+	if _, err := db.GetAttributes(ctx, "does-not-exist"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("unknown device: have %v, want ErrNotFound", err)
+	}
+}
+
+func TestSetAttributeInvalid(t *testing.T) {
+	db := lazySetup(t)
+	ctx := context.Background()
+	if err := db.SetAttribute(ctx, "attr-1", "", "sales"); !errors.Is(err, ErrValidation) {
+		t.Errorf("empty key: have %v, want ErrValidation", err)
+	}
+	if err := db.SetAttribute(ctx, "attr-1", "callback", func() {}); !errors.Is(err, ErrValidation) {
+		t.Errorf("unencodable value: have %v, want ErrValidation", err)
+	}
+}
+
+func TestSelectDevicesAttributeEquals(t *testing.T) {
+	stmt, err := selectDevices(tableName, tagTableName, AttributeEquals{Key: "department'; --", Value: "sales"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	query, args, err := stmt.ToSql()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(query, "WHERE custom_attributes ->> $1::text = $2") {
+		t.Errorf("attribute filter not parameterized: %s", query)
+	}
+	if have, want := fmt.Sprint(args), "[department'; -- sales]"; have != want {
+		t.Errorf("have args %s, want %s", have, want)
+	}
+}
+
+func TestSearch(t *testing.T) {
+	db := setup(t)
+	ctx := context.Background()
+	resetDevices(t, db)
+	defer resetDevices(t, db)
+
+	devs := []*device.Device{
+		{UUID: "search-serial", UDID: "search-serial", SerialNumber: "C02XYZ123"},
+		{UUID: "search-model", UDID: "search-model", Model: "MacBookAir8,1"},
+		{UUID: "search-description", UDID: "search-description", Description: "Loaner 100% charged"},
+	}
+	for _, dev := range devs {
+		if err := db.Save(ctx, dev); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		term string
+		want []string
+	}{
+		{"xyz1", []string{"search-serial"}},
+		{"macbookair", []string{"search-model"}},
+		{"100%", []string{"search-description"}},
+		{"_", nil},
+		{"no such device", nil},
+	}
+	for _, tt := range tests {
+		found, err := db.Search(ctx, tt.term, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var have []string
+		for _, dev := range found {
+			have = append(have, dev.UUID)
+		}
+		if fmt.Sprint(have) != fmt.Sprint(tt.want) {
+			t.Errorf("search %q: have %v, want %v", tt.term, have, tt.want)
+		}
+	}
+}
+
+func TestEscapeLike(t *testing.T) {
+	if have, want := escapeLike(`50%_off\`), `50\%\_off\\`; have != want {
+		t.Errorf("have %s, want %s", have, want)
+	}
+}
+
+func TestDevicesLastSeenBefore(t *testing.T) {
+	db := setup(t)
+	ctx := context.Background()
+	resetDevices(t, db)
+
+	now := time.Now().UTC()
+	devs := []*device.Device{
+		{UUID: "seen-today", UDID: "seen-today", LastSeen: now},
+		{UUID: "seen-last-month", UDID: "seen-last-month", LastSeen: now.Add(-30 * 24 * time.Hour)},
+	}
+	for _, dev := range devs {
+		if err := db.Save(ctx, dev); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer resetDevices(t, db)
+
+	stale, err := db.Devices(ctx, LastSeenBefore{Time: now.Add(-7 * 24 * time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := len(stale), 1; have != want {
+		t.Fatalf("have %d devices, want %d", have, want)
+	}
+	if have, want := stale[0].UUID, "seen-last-month"; have != want {
+		t.Errorf("have %s, want %s", have, want)
+	}
+}
+
+func TestDevicesEnrolledBetween(t *testing.T) {
+	db := setup(t)
+	ctx := context.Background()
+	resetDevices(t, db)
+	defer resetDevices(t, db)
+
+	now := time.Now().UTC()
+	enrolledAt := map[string]time.Time{
+		"enrolled-today":     now.Add(-2 * time.Hour),
+		"enrolled-last-week": now.Add(-7 * 24 * time.Hour),
+		"enrolled-yesterday": now.Add(-20 * time.Hour),
+	}
+	for id, at := range enrolledAt {
+		if err := db.Save(ctx, &device.Device{UUID: id, UDID: id, Enrolled: true}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.db.ExecContext(ctx, `UPDATE devices SET enrolled_at = $1 WHERE uuid = $2`, at, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Save(ctx, &device.Device{UUID: "never-enrolled", UDID: "never-enrolled"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// checking in again must not move the enrollment time.
+	if err := db.Save(ctx, &device.Device{UUID: "enrolled-last-week", UDID: "enrolled-last-week", Enrolled: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	found, err := db.Devices(ctx, EnrolledBetween{Start: now.Add(-24 * time.Hour), End: now})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, dev := range found {
+		ids = append(ids, dev.UUID)
+	}
+	if have, want := strings.Join(ids, ","), "enrolled-today,enrolled-yesterday"; have != want {
+		t.Errorf("have %s, want %s", have, want)
+	}
+}
+
+func TestUpdateDeviceEnrolledAt(t *testing.T) {
+	db := setup(t)
+	ctx := context.Background()
+	resetDevices(t, db)
+	defer resetDevices(t, db)
+
+	if err := db.Save(ctx, &device.Device{UUID: "update-enrolled", UDID: "update-enrolled"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.UpdateDevice(ctx, &device.Device{UUID: "update-enrolled", Enrolled: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	window := EnrolledBetween{Start: time.Now().Add(-time.Hour), End: time.Now().Add(time.Hour)}
+	found, err := db.Devices(ctx, window)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := deviceUUIDs(found), []string{"update-enrolled"}; !reflect.DeepEqual(have, want) {
+		t.Errorf("have %v, want %v", have, want)
+	}
+
+	// updating an enrolled device again must not move the enrollment time.
+	lastWeek := time.Now().Add(-7 * 24 * time.Hour)
+	if _, err := db.db.ExecContext(ctx, `UPDATE devices SET enrolled_at = $1 WHERE uuid = $2`, lastWeek, "update-enrolled"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.UpdateDevice(ctx, &device.Device{UUID: "update-enrolled", Enrolled: true, OSVersion: "13.4"}); err != nil {
+		t.Fatal(err)
+	}
+	if found, err := db.Devices(ctx, window); err != nil || len(found) != 0 {
+		t.Errorf("enrollment time moved: %v, %v", deviceUUIDs(found), err)
+	}
+}
+
+func TestSelectDevicesEnrolledBetween(t *testing.T) {
+	start, end := time.Now().Add(-time.Hour), time.Now()
+	stmt, err := selectDevices(tableName, tagTableName, EnrolledBetween{Start: start, End: end})
+	if err != nil {
+		t.Fatal(err)
+	}
+	query, args, err := stmt.ToSql()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(query, "WHERE enrolled_at BETWEEN $1 AND $2") {
+		t.Errorf("query %q does not contain a parameterized BETWEEN", query)
+	}
+	if have, want := len(args), 2; have != want {
+		t.Fatalf("have %d args, want %d", have, want)
+	}
+}
+
+func TestDevicesOSVersionLessThan(t *testing.T) {
+	db := setup(t)
+	ctx := context.Background()
+	resetDevices(t, db)
+	defer resetDevices(t, db)
+
+	versions := map[string]string{
+		"ios-9":       "9.3.5",
+		"ios-16":      "16",
+		"ios-16-1":    "16.1",
+		"ios-16-0-1":  "16.0.1",
+		"ios-16-10":   "16.10",
+		"ios-unknown": "",
+	}
+	for id, version := range versions {
+		if err := db.Save(ctx, &device.Device{UUID: id, UDID: id, OSVersion: version}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		version string
+		want    string
+	}{
+		{version: "16", want: "ios-9"},
+		{version: "16.0", want: "ios-9"},
+		{version: "16.1", want: "ios-16,ios-16-0-1,ios-9"},
+		{version: "16.2", want: "ios-16,ios-16-0-1,ios-16-1,ios-9"},
+		{version: "17", want: "ios-16,ios-16-0-1,ios-16-1,ios-16-10,ios-9"},
+		{version: "9.3.5", want: ""},
+	}
+	for _, tt := range tests {
+		found, err := db.Devices(ctx, OSVersionLessThan{Version: tt.version}, OrderBy{Column: "uuid"})
+		if err != nil {
+			t.Fatalf("%s: %v", tt.version, err)
+		}
+		var ids []string
+		for _, dev := range found {
+			ids = append(ids, dev.UUID)
+		}
+		if have := strings.Join(ids, ","); have != tt.want {
+			t.Errorf("less than %s: have %s, want %s", tt.version, have, tt.want)
+		}
+	}
+}
+
+func TestParseOSVersion(t *testing.T) {
+	tests := []struct {
+		version string
+		want    []int64
+		wantErr bool
+	}{
+		{version: "9.3.5", want: []int64{9, 3, 5}},
+		{version: "16.1", want: []int64{16, 1}},
+		{version: "16.0.0", want: []int64{16}},
+		{version: "", wantErr: true},
+		{version: "16.x", wantErr: true},
+		{version: "16..1", wantErr: true},
+	}
+	for _, tt := range tests {
+		have, err := parseOSVersion(tt.version)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%q: have err %v, want err %v", tt.version, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(have, tt.want) {
+			t.Errorf("%q: have %v, want %v", tt.version, have, tt.want)
+		}
+	}
+
+	stmt, err := selectDevices(tableName, tagTableName, OSVersionLessThan{Version: "16"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	query, _, err := stmt.ToSql()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(query, "(?:") || !strings.Contains(query, "< $1::int[]") {
+		t.Errorf("unexpected os version clause in %q", query)
+	}
+}
+
+func TestFilterIndexesExist(t *testing.T) {
+	db := setup(t)
+
+	for _, index := range []string{
+		"devices_dep_profile_status_idx",
+		"devices_model_idx",
+		"devices_workflow_uuid_idx",
+		"devices_imei_idx",
+		"devices_meid_idx",
+	} {
+		var exists bool
+		err := db.db.Get(&exists, `SELECT EXISTS(SELECT 1 FROM pg_indexes WHERE tablename = 'devices' AND indexname = $1);`, index)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !exists {
+			t.Errorf("index %s does not exist", index)
+		}
+	}
+}
+
+func TestErrNotFound(t *testing.T) {
+	db := setup(t)
+	ctx := context.Background()
+
+	_, err := db.DeviceByUDID(ctx, "UDID-does-not-exist")
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("have %v, want %v", err, ErrNotFound)
+	}
+
+	wrapped := errors.Wrap(err, "looking up device")
+	if !errors.Is(wrapped, ErrNotFound) {
+		t.Errorf("errors.Is does not match ErrNotFound through wrapping: %v", wrapped)
+	}
+}
+
+func TestSelectDevicesBindsFilterArgs(t *testing.T) {
+	malicious := "'; DROP TABLE devices;--"
+	stmt, err := selectDevices(tableName, tagTableName, UUID{UUID: malicious})
+	if err != nil {
+		t.Fatal(err)
+	}
+	query, args, err := stmt.ToSql()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(query, malicious) {
+		t.Errorf("query contains unescaped filter value: %s", query)
+	}
+	if !strings.Contains(query, "uuid = $1") {
+		t.Errorf("query missing placeholder: %s", query)
+	}
+	if have, want := len(args), 1; have != want {
+		t.Fatalf("have %d args, want %d", have, want)
+	}
+	if have, want := args[0], malicious; have != want {
+		t.Errorf("have %v, want %v", have, want)
+	}
+}
+
+func TestSelectDevicesJoinsFiltersWithAnd(t *testing.T) {
+	stmt, err := selectDevices(tableName, tagTableName, UUID{UUID: "foo"}, SerialNumber{SerialNumber: "bar"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	query, args, err := stmt.ToSql()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(query, "WHERE uuid = $1 AND serial_number = $2 AND deleted_at IS NULL") {
+		t.Errorf("filters not joined with AND: %s", query)
+	}
+	if have, want := len(args), 2; have != want {
+		t.Errorf("have %d args, want %d", have, want)
+	}
+}
+
+func TestSelectDevicesOrFilters(t *testing.T) {
+	stmt, err := selectDevices(
+		tableName,
+		tagTableName,
+		Enrolled{Enrolled: true},
+		sq.Or{ModelLike{Pattern: "iPhone%"}, ModelLike{Pattern: "iPad%"}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query, args, err := stmt.ToSql()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(query, "WHERE enrolled = $1 AND (model ILIKE $2 OR model ILIKE $3) AND deleted_at IS NULL") {
+		t.Errorf("or filters not parenthesized inside the AND: %s", query)
+	}
+	if have, want := fmt.Sprint(args), "[true iPhone% iPad%]"; have != want {
+		t.Errorf("have args %s, want %s", have, want)
+	}
+}
+
+func TestSelectDevicesNotFilter(t *testing.T) {
+	stmt, err := selectDevices(
+		tableName,
+		tagTableName,
+		Enrolled{Enrolled: true},
+		Not{sq.Or{DEPProfileStatus{Status: device.ASSIGNED}, ModelLike{Pattern: "iPad%"}}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query, args, err := stmt.ToSql()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(query, "WHERE enrolled = $1 AND NOT ((dep_profile_status = $2 OR model ILIKE $3)) AND deleted_at IS NULL") {
+		t.Errorf("negated filter not parameterized inside the AND: %s", query)
+	}
+	if have, want := fmt.Sprint(args), "[true assigned iPad%]"; have != want {
+		t.Errorf("have args %s, want %s", have, want)
+	}
+}
+
+func TestReadReplica(t *testing.T) {
+	primary, replica := lazySetup(t).db, lazySetup(t).db
+
+	d := New(primary, WithReadReplica(replica))
+	if d.conn() != primary {
+		t.Error("writes do not use the primary database")
+	}
+	if d.readConn() != replica {
+		t.Error("reads do not use the read replica")
+	}
+
+	if New(primary).readConn() != primary {
+		t.Error("reads without a replica do not fall back to the primary database")
+	}
+
+	tx := &Postgres{db: primary, replica: replica, tx: &sqlx.Tx{}}
+	if tx.readConn() != tx.tx {
+		t.Error("reads in a transaction do not use the transaction")
+	}
+}
+
+func TestPing(t *testing.T) {
+	db := setup(t)
+	if err := db.Ping(context.Background()); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPingClosed(t *testing.T) {
+	db := lazySetup(t)
+	if err := db.db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Ping(context.Background()); err == nil {
+		t.Error("expected an error pinging a closed database")
+	}
+}
+
+func TestClose(t *testing.T) {
+	db := lazySetup(t)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := db.Devices(context.Background())
+	if err == nil {
+		t.Fatal("expected an error querying a closed store")
+	}
+	if !strings.Contains(err.Error(), "database is closed") {
+		t.Errorf("unclear error after close: %v", err)
+	}
+}
+
+func TestWithSchema(t *testing.T) {
+	db := setup(t)
+	ctx := context.Background()
+
+	tenants := map[string]*Postgres{}
+	for _, schema := range []string{"tenant_a", "tenant_b"} {
+		for _, stmt := range []string{
+			`DROP SCHEMA IF EXISTS ` + schema + ` CASCADE;`,
+			`CREATE SCHEMA ` + schema + `;`,
+			`CREATE TABLE ` + schema + `.devices (LIKE public.devices INCLUDING ALL);`,
+		} {
+			if _, err := db.db.ExecContext(ctx, stmt); err != nil {
+				t.Fatal(err)
+			}
+		}
+		defer db.db.ExecContext(ctx, `DROP SCHEMA IF EXISTS `+schema+` CASCADE;`)
+		tenants[schema] = New(db.db, WithSchema(schema))
+	}
+
+	dev := device.Device{UUID: "tenant-device", SerialNumber: "C02TENANT", Enrolled: true}
+	if err := tenants["tenant_a"].Save(ctx, &dev); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := tenants["tenant_a"].DeviceBySerial(ctx, dev.SerialNumber); err != nil {
+		t.Errorf("tenant_a: %v", err)
+	}
+	if _, err := tenants["tenant_b"].DeviceBySerial(ctx, dev.SerialNumber); !errors.Is(err, ErrNotFound) {
+		t.Errorf("tenant_b: have %v, want ErrNotFound", err)
+	}
+	if _, err := db.DeviceBySerial(ctx, dev.SerialNumber); !errors.Is(err, ErrNotFound) {
+		t.Errorf("default schema: have %v, want ErrNotFound", err)
+	}
+}
+
+func TestWithSchemaHasTag(t *testing.T) {
+	db := New(lazySetup(t).db, WithSchema("tenant"))
+	stmt, err := selectDevices(db.table, db.tagTable,
+		sq.Or{HasTag{Tag: "lab"}, Not{HasTag{Tag: "loaner"}}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query, args, err := stmt.ToSql()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := strings.Count(query, `FROM "tenant".device_tags WHERE tag = `), 2; have != want {
+		t.Errorf("tag filters not read from the tenant schema: %s", query)
+	}
+	if have, want := fmt.Sprint(args), "[lab loaner]"; have != want {
+		t.Errorf("have args %s, want %s", have, want)
+	}
+
+	if _, _, err := (HasTag{Tag: "lab"}).ToSql(); err == nil {
+		t.Error("expected an error using HasTag outside of a device query")
+	}
+}
+
+func TestWithSchemaQuotesName(t *testing.T) {
+	db := New(lazySetup(t).db, WithSchema(`tenant"; DROP TABLE devices;--`))
+	stmt, err := selectDevices(db.table, db.tagTable)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query, _, err := stmt.ToSql()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(query, `FROM "tenant""; DROP TABLE devices;--".devices`) {
+		t.Errorf("schema name not quoted: %s", query)
+	}
+}
+
+func TestCancelledContext(t *testing.T) {
+	// a cancelled context must fail before any connection to the database is attempted.
+	db := lazySetup(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := db.Devices(ctx); errors.Cause(err) != context.Canceled {
+		t.Errorf("Devices: have %v, want %v", err, context.Canceled)
+	}
+	if _, err := db.DeviceByUDID(ctx, "foobar"); errors.Cause(err) != context.Canceled {
+		t.Errorf("DeviceByUDID: have %v, want %v", err, context.Canceled)
+	}
+	if err := db.Save(ctx, &device.Device{UUID: "foobar", UDID: "foobar"}); errors.Cause(err) != context.Canceled {
+		t.Errorf("Save: have %v, want %v", err, context.Canceled)
+	}
+}
+
+func resetDevices(t testing.TB, db *Postgres) {
+	t.Helper()
+	if _, err := db.db.Exec(`DELETE FROM devices;`); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSaveValidatesDevice(t *testing.T) {
+	db := lazySetup(t)
+	ctx := context.Background()
+
+	if err := db.Save(ctx, &device.Device{UDID: "UDID-no-uuid"}); !errors.Is(err, ErrValidation) {
+		t.Errorf("saving a device without a uuid: have %v, want ErrValidation", err)
+	}
+	if err := db.BulkSave(ctx, []*device.Device{{UUID: "no-identifiers"}}); !errors.Is(err, ErrValidation) {
+		t.Errorf("bulk saving a device without a serial number or udid: have %v, want ErrValidation", err)
+	}
+	if _, err := db.SaveManualEnrollment(ctx, &device.Device{UUID: "no-udid", SerialNumber: "C02NOUDID"}); !errors.Is(err, ErrValidation) {
+		t.Errorf("manual enrollment without a udid: have %v, want ErrValidation", err)
+	}
+	if err := db.UpdateDevice(ctx, &device.Device{UUID: "no-fields"}); !errors.Is(err, ErrValidation) {
+		t.Errorf("update without fields: have %v, want ErrValidation", err)
+	}
+}
+
+func TestWriteErrors(t *testing.T) {
+	db := setup(t)
+	ctx := context.Background()
+	resetDevices(t, db)
+	defer resetDevices(t, db)
+
+	if err := db.Save(ctx, &device.Device{UUID: "conflict-1", UDID: "UDID-CONFLICT", SerialNumber: "C02CONFLICT1", AssetTag: "IT-0100"}); err != nil {
+		t.Fatal(err)
+	}
+
+	conflicts := []struct {
+		name string
+		dev  device.Device
+	}{
+		{"udid", device.Device{UUID: "conflict-2", UDID: "UDID-CONFLICT"}},
+		{"serial number", device.Device{UUID: "conflict-2", SerialNumber: "c02conflict1"}},
+		{"asset tag", device.Device{UUID: "conflict-2", SerialNumber: "C02CONFLICT2", AssetTag: "IT-0100"}},
+	}
+	for _, tt := range conflicts {
+		err := db.Save(ctx, &tt.dev)
+		if !errors.Is(err, ErrConflict) {
+			t.Errorf("%s: have %v, want ErrConflict", tt.name, err)
+		}
+		if errors.Is(err, ErrValidation) || errors.Is(err, ErrNotFound) {
+			t.Errorf("%s: %v matches the wrong sentinel", tt.name, err)
+		}
+	}
+
+	if err := db.UpdateDevice(ctx, &device.Device{UUID: "does-not-exist", Model: "iPad"}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("update of a missing device: have %v, want ErrNotFound", err)
+	}
+	if err := db.Save(ctx, &device.Device{UUID: "conflict-3"}); !errors.Is(err, ErrValidation) {
+		t.Errorf("invalid device: have %v, want ErrValidation", err)
+	}
+}
+
+// lazySetup returns a store which does not connect to the database until it is used.
+func lazySetup(t testing.TB) *Postgres {
+	db, err := sqlx.Open("postgres", "host=localhost port=5432 user=micromdm dbname=micromdm_test password=micromdm sslmode=disable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return New(db)
+}
+
+func setup(t testing.TB) *Postgres {
+	db, err := dbutil.OpenDBX(
+		"postgres",
+		"host=localhost port=5432 user=micromdm dbname=micromdm_test password=micromdm sslmode=disable",
+		dbutil.WithLogger(log.NewNopLogger()),
+		dbutil.WithMaxAttempts(1),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return New(db)
+}
+
+// deviceUUIDs returns the uuids of devices, in order.
+func deviceUUIDs(devices []device.Device) []string {
+	var uuids []string
+	for _, dev := range devices {
+		uuids = append(uuids, dev.UUID)
+	}
+	return uuids
 }
@@ -0,0 +1,132 @@
+package pg
+
+import (
+	"github.com/pkg/errors"
+	sq "gopkg.in/Masterminds/squirrel.v1"
+)
+
+// Limit caps the number of devices returned. A zero value means no limit.
+type Limit struct {
+	N int
+}
+
+// Offset skips the first N devices of the result.
+type Offset struct {
+	N int
+}
+
+// OrderBy sorts the devices by Column, which must be one of the columns
+// allowed for ordering. Devices are ordered by uuid if no OrderBy is given.
+type OrderBy struct {
+	Column string
+	Desc   bool
+}
+
+var orderByColumns = map[string]bool{
+	"uuid":               true,
+	"serial_number":      true,
+	"model":              true,
+	"dep_profile_status": true,
+}
+
+func (o OrderBy) clause() (string, error) {
+	if !orderByColumns[o.Column] {
+		return "", errors.Errorf("cannot order devices by column %q", o.Column)
+	}
+	if o.Desc {
+		return o.Column + " DESC", nil
+	}
+	return o.Column + " ASC", nil
+}
+
+// IncludeDeleted includes soft deleted devices in the result.
+type IncludeDeleted struct{}
+
+// deviceQuery holds the parsed parameters of a device query.
+type deviceQuery struct {
+	where          []sq.Sqlizer
+	orderBy        []string
+	limit, offset  uint64
+	includeDeleted bool
+}
+
+func parseParams(tagTable string, params ...interface{}) (deviceQuery, error) {
+	var q deviceQuery
+	for _, p := range params {
+		switch p := p.(type) {
+		case IncludeDeleted:
+			q.includeDeleted = true
+		case OrderBy:
+			clause, err := p.clause()
+			if err != nil {
+				return q, err
+			}
+			q.orderBy = append(q.orderBy, clause)
+		case Limit:
+			if p.N < 0 {
+				return q, errors.Errorf("invalid limit %d", p.N)
+			}
+			q.limit = uint64(p.N)
+		case Offset:
+			if p.N < 0 {
+				return q, errors.Errorf("invalid offset %d", p.N)
+			}
+			q.offset = uint64(p.N)
+		case sq.Sqlizer:
+			q.where = append(q.where, withTagTable(p, tagTable))
+		default:
+			return q, errors.Errorf("unsupported device query parameter %T", p)
+		}
+	}
+	return q, nil
+}
+
+// filter adds the WHERE clause of the query to stmt.
+func (q deviceQuery) filter(stmt sq.SelectBuilder) sq.SelectBuilder {
+	for _, w := range q.where {
+		stmt = stmt.Where(w)
+	}
+	if !q.includeDeleted {
+		stmt = stmt.Where(notDeleted)
+	}
+	return stmt
+}
+
+// apply adds the WHERE, ORDER BY, LIMIT and OFFSET clauses of the query to stmt.
+func (q deviceQuery) apply(stmt sq.SelectBuilder) sq.SelectBuilder {
+	stmt = q.filter(stmt)
+	if len(q.orderBy) == 0 {
+		stmt = stmt.OrderBy("uuid")
+	} else {
+		stmt = stmt.OrderBy(q.orderBy...)
+	}
+	if q.limit > 0 {
+		stmt = stmt.Limit(q.limit)
+	}
+	if q.offset > 0 {
+		stmt = stmt.Offset(q.offset)
+	}
+	return stmt
+}
+
+func selectDevices(table, tagTable string, params ...interface{}) (sq.SelectBuilder, error) {
+	q, err := parseParams(tagTable, params...)
+	if err != nil {
+		return sq.SelectBuilder{}, err
+	}
+	stmt := sq.StatementBuilder.PlaceholderFormat(sq.Dollar).
+		Select(selectColumns()...).
+		From(table)
+	return q.apply(stmt), nil
+}
+
+func countDevices(table, tagTable string, params ...interface{}) (sq.SelectBuilder, error) {
+	q, err := parseParams(tagTable, params...)
+	if err != nil {
+		return sq.SelectBuilder{}, err
+	}
+	stmt := sq.StatementBuilder.PlaceholderFormat(sq.Dollar).
+		Select("COUNT(*)").
+		From(table)
+	return q.filter(stmt), nil
+}
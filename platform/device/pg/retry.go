@@ -0,0 +1,49 @@
+package pg
+
+import (
+	"context"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+)
+
+// maxSaveAttempts is the number of times Save runs its upsert when it keeps failing
+// with a serialization failure or a deadlock.
+const maxSaveAttempts = 3
+
+// retryBackoff is the wait before the second attempt. Each further attempt waits one
+// retryBackoff longer.
+var retryBackoff = 10 * time.Millisecond
+
+// retryable reports whether err is a Postgres serialization failure (40001) or deadlock (40P01).
+// Either can happen when concurrent upserts race on the same device, and running the
+// statement again is expected to succeed.
+func retryable(err error) bool {
+	pqErr, ok := errors.Cause(err).(*pq.Error)
+	if !ok {
+		return false
+	}
+	switch pqErr.Code {
+	case "40001", "40P01":
+		return true
+	default:
+		return false
+	}
+}
+
+// withRetry calls fn until it succeeds, fails with an error that is not retryable,
+// or has been called maxSaveAttempts times. The last error is returned.
+func withRetry(ctx context.Context, fn func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || !retryable(err) || attempt == maxSaveAttempts || ctx.Err() != nil {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(time.Duration(attempt) * retryBackoff):
+		}
+	}
+}
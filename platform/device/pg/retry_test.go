@@ -0,0 +1,67 @@
+package pg
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+)
+
+func TestWithRetry(t *testing.T) {
+	defer func(backoff time.Duration) { retryBackoff = backoff }(retryBackoff)
+	retryBackoff = 0
+
+	serializationFailure := &pq.Error{Code: "40001"}
+	deadlock := &pq.Error{Code: "40P01"}
+	uniqueViolation := &pq.Error{Code: "23505"}
+
+	tests := []struct {
+		name      string
+		errs      []error
+		wantCalls int
+		wantErr   error
+	}{
+		{"success", nil, 1, nil},
+		{"serialization failure then success", []error{serializationFailure}, 2, nil},
+		{"deadlock then success", []error{errors.Wrap(deadlock, "exec"), deadlock}, 3, nil},
+		{"attempts exhausted", []error{deadlock, deadlock, deadlock, deadlock}, maxSaveAttempts, deadlock},
+		{"not retryable", []error{uniqueViolation}, 1, uniqueViolation},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls int
+			err := withRetry(context.Background(), func() error {
+				calls++
+				if calls <= len(tt.errs) {
+					return tt.errs[calls-1]
+				}
+				return nil
+			})
+			if errors.Cause(err) != tt.wantErr {
+				t.Errorf("have err %v, want %v", err, tt.wantErr)
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("have %d calls, want %d", calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestWithRetryCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	var calls int
+	err := withRetry(ctx, func() error {
+		calls++
+		return &pq.Error{Code: "40001"}
+	})
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if calls != 1 {
+		t.Errorf("have %d calls, want 1", calls)
+	}
+}
@@ -0,0 +1,69 @@
+package pg
+
+import (
+	"context"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+
+	"github.com/micromdm/micromdm/platform/device"
+)
+
+// DeviceRows is a cursor over the result of DevicesIter.
+// Devices are scanned one row at a time, so the result is never held in memory.
+// Close must be called when the caller is done with the rows.
+//
+//	rows, err := d.DevicesIter(ctx)
+//	if err != nil { ... }
+//	defer rows.Close()
+//	for rows.Next() {
+//		dev := rows.Device()
+//		...
+//	}
+//	if err := rows.Err(); err != nil { ... }
+type DeviceRows struct {
+	rows *sqlx.Rows
+	dev  device.Device
+	err  error
+
+	// the query context, bounded by the statement timeout
+	ctx     context.Context
+	cancel  context.CancelFunc
+	timeout time.Duration
+}
+
+// Next scans the next device, and reports whether there was one.
+// When Next returns false, Err reports whether the iteration stopped on an error.
+func (r *DeviceRows) Next() bool {
+	if r.err != nil || !r.rows.Next() {
+		return false
+	}
+	r.dev = device.Device{}
+	if err := r.rows.StructScan(&r.dev); err != nil {
+		r.err = errors.Wrap(err, "scan device row")
+		return false
+	}
+	return true
+}
+
+// Device returns the device scanned by the last call to Next.
+func (r *DeviceRows) Device() device.Device {
+	return r.dev
+}
+
+// Err returns the error, if any, that stopped the iteration.
+func (r *DeviceRows) Err() error {
+	err := r.err
+	if err == nil {
+		err = errors.Wrap(r.rows.Err(), "iterate device rows")
+	}
+	return statementTimeoutErr(r.ctx, r.timeout, err)
+}
+
+// Close releases the connection held by the rows. It is safe to call more than once.
+func (r *DeviceRows) Close() error {
+	err := r.rows.Close()
+	r.cancel()
+	return errors.Wrap(err, "close device rows")
+}
@@ -0,0 +1,70 @@
+package pg
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+)
+
+// expectedColumns returns every devices column the store reads or writes.
+func expectedColumns() []string {
+	return append(columns(),
+		"created_at",
+		"updated_at",
+		"deleted_at",
+		"workflow_uuid",
+		"enrolled_at",
+		"dep_assign_error",
+		"dep_assign_attempts",
+		"last_push_at",
+		"last_push_error",
+		"push_claimed_at",
+		"custom_attributes",
+	)
+}
+
+// NewChecked returns a store using db like New, after checking the schema of its devices table
+// with CheckSchema. The caller still owns db, which is left open if the check fails.
+func NewChecked(ctx context.Context, db *sqlx.DB, opts ...Option) (*Postgres, error) {
+	d := New(db, opts...)
+	if err := d.CheckSchema(ctx); err != nil {
+		if d.monitor != nil {
+			d.monitor.close()
+		}
+		return nil, err
+	}
+	return d, nil
+}
+
+// CheckSchema returns an error listing the columns the store uses which are missing from the
+// devices table, which happens when the database has not been migrated to the latest version.
+// Without the check, the first query using a missing column would fail instead.
+func (d *Postgres) CheckSchema(ctx context.Context) error {
+	var live []string
+	err := d.db.SelectContext(ctx, &live,
+		`SELECT attname FROM pg_attribute WHERE attrelid = $1::regclass AND attnum > 0 AND NOT attisdropped`,
+		d.table,
+	)
+	if err != nil {
+		return errors.Wrapf(err, "list columns of %s", d.table)
+	}
+	have := make(map[string]bool, len(live))
+	for _, col := range live {
+		have[col] = true
+	}
+
+	var missing []string
+	for _, col := range expectedColumns() {
+		if !have[col] {
+			missing = append(missing, col)
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return errors.Errorf("%s is missing columns %s, migrate the database", d.table, strings.Join(missing, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package pg
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestCheckSchema(t *testing.T) {
+	db := setup(t)
+	ctx := context.Background()
+
+	if err := db.CheckSchema(ctx); err != nil {
+		t.Errorf("migrated schema: %v", err)
+	}
+
+	// a devices table created by an old version, before most columns were added.
+	for _, stmt := range []string{
+		`DROP SCHEMA IF EXISTS stale CASCADE;`,
+		`CREATE SCHEMA stale;`,
+		`CREATE TABLE stale.devices (uuid TEXT PRIMARY KEY, udid TEXT DEFAULT '', serial_number TEXT DEFAULT '');`,
+	} {
+		if _, err := db.db.ExecContext(ctx, stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer db.db.ExecContext(ctx, `DROP SCHEMA IF EXISTS stale CASCADE;`)
+
+	err := New(db.db, WithSchema("stale")).CheckSchema(ctx)
+	if err == nil {
+		t.Fatal("expected the stale schema to be reported")
+	}
+	for _, want := range []string{"os_version", "total_storage", "deleted_at", "push_claimed_at"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not list missing column %s", err, want)
+		}
+	}
+	if strings.Contains(err.Error(), "serial_number") {
+		t.Errorf("error %q lists a column which exists", err)
+	}
+
+	if err := New(db.db, WithSchema("does_not_exist")).CheckSchema(ctx); err == nil {
+		t.Error("expected an error for a missing table")
+	}
+}
+
+func TestNewChecked(t *testing.T) {
+	db := setup(t)
+	ctx := context.Background()
+
+	if _, err := NewChecked(ctx, db.db); err != nil {
+		t.Errorf("migrated schema: %v", err)
+	}
+
+	for _, stmt := range []string{
+		`DROP SCHEMA IF EXISTS stale CASCADE;`,
+		`CREATE SCHEMA stale;`,
+		`CREATE TABLE stale.devices (uuid TEXT PRIMARY KEY);`,
+	} {
+		if _, err := db.db.ExecContext(ctx, stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer db.db.ExecContext(ctx, `DROP SCHEMA IF EXISTS stale CASCADE;`)
+
+	d, err := NewChecked(ctx, db.db, WithSchema("stale"), WithHealthMonitor(time.Hour, log.NewNopLogger()))
+	if err == nil || !strings.Contains(err.Error(), "os_version") {
+		t.Fatalf("stale schema: have %v, want missing columns", err)
+	}
+	if d != nil {
+		t.Error("returned a store for a stale schema")
+	}
+	// the caller's database is left open.
+	if err := db.Ping(ctx); err != nil {
+		t.Errorf("database closed by NewChecked: %v", err)
+	}
+}
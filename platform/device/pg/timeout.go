@@ -0,0 +1,69 @@
+package pg
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+)
+
+// WithStatementTimeout cancels any single device query which runs longer than timeout.
+// A cancelled query returns an error saying it exceeded the statement timeout.
+func WithStatementTimeout(timeout time.Duration) Option {
+	return func(d *Postgres) {
+		d.timeout = timeout
+	}
+}
+
+// withTimeout returns ctx bounded by the statement timeout, if one is set.
+func (d *Postgres) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if d.timeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, d.timeout)
+}
+
+// timeoutErr explains err if it was caused by ctx reaching the statement timeout.
+func (d *Postgres) timeoutErr(ctx context.Context, err error) error {
+	return statementTimeoutErr(ctx, d.timeout, err)
+}
+
+func statementTimeoutErr(ctx context.Context, timeout time.Duration, err error) error {
+	if err != nil && timeout > 0 && ctx.Err() == context.DeadlineExceeded {
+		return errors.Wrapf(err, "device query exceeded the statement timeout of %s", timeout)
+	}
+	return err
+}
+
+// timeoutQueryer runs each statement with a context bounded by timeout.
+// QueryxContext is passed through unchanged, because the timeout must outlive the
+// returned rows; DevicesIter applies it around the whole iteration instead.
+type timeoutQueryer struct {
+	q       queryer
+	timeout time.Duration
+}
+
+func (t timeoutQueryer) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+	result, err := t.q.ExecContext(ctx, query, args...)
+	return result, statementTimeoutErr(ctx, t.timeout, err)
+}
+
+func (t timeoutQueryer) GetContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error {
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+	return statementTimeoutErr(ctx, t.timeout, t.q.GetContext(ctx, dest, query, args...))
+}
+
+func (t timeoutQueryer) SelectContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error {
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+	return statementTimeoutErr(ctx, t.timeout, t.q.SelectContext(ctx, dest, query, args...))
+}
+
+func (t timeoutQueryer) QueryxContext(ctx context.Context, query string, args ...interface{}) (*sqlx.Rows, error) {
+	return t.q.QueryxContext(ctx, query, args...)
+}
@@ -0,0 +1,72 @@
+package pg
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+func TestStatementTimeout(t *testing.T) {
+	db := New(setup(t).db, WithStatementTimeout(50*time.Millisecond))
+	ctx := context.Background()
+
+	_, err := db.conn().ExecContext(ctx, `SELECT pg_sleep(2)`)
+	if err == nil {
+		t.Fatal("expected the slow query to be cancelled")
+	}
+	if !strings.Contains(err.Error(), "statement timeout") {
+		t.Errorf("unclear timeout error: %v", err)
+	}
+
+	// queries within the timeout are unaffected.
+	if _, err := db.Devices(ctx, Limit{N: 1}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTimeoutQueryer(t *testing.T) {
+	q := timeoutQueryer{q: blockingQueryer{}, timeout: 10 * time.Millisecond}
+	ctx := context.Background()
+
+	if _, err := q.ExecContext(ctx, "UPDATE devices SET model = ''"); err == nil || !strings.Contains(err.Error(), "statement timeout of 10ms") {
+		t.Errorf("exec: have %v, want a statement timeout error", err)
+	}
+	var n int
+	if err := q.GetContext(ctx, &n, "SELECT COUNT(*) FROM devices"); err == nil || !strings.Contains(err.Error(), "statement timeout of 10ms") {
+		t.Errorf("get: have %v, want a statement timeout error", err)
+	}
+
+	// cancelling the caller's context is not reported as a timeout.
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := q.GetContext(cancelled, &n, "SELECT COUNT(*) FROM devices"); err == nil || strings.Contains(err.Error(), "statement timeout") {
+		t.Errorf("cancelled: have %v, want a cancellation error", err)
+	}
+}
+
+// blockingQueryer blocks every statement until its context is done.
+type blockingQueryer struct{}
+
+func (blockingQueryer) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (blockingQueryer) GetContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func (blockingQueryer) SelectContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func (blockingQueryer) QueryxContext(ctx context.Context, query string, args ...interface{}) (*sqlx.Rows, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
@@ -2,6 +2,7 @@ package device
 
 import (
 	"context"
+	"encoding/json"
 	"time"
 
 	"github.com/go-kit/kit/log"
@@ -21,17 +22,66 @@ type DeviceWorkerStore interface {
 }
 
 type Worker struct {
-	db     DeviceWorkerStore
-	ps     pubsub.PublishSubscriber
-	logger log.Logger
+	db           DeviceWorkerStore
+	ps           pubsub.PublishSubscriber
+	logger       log.Logger
+	updateEvents bool
 }
 
-func NewWorker(db DeviceWorkerStore, ps pubsub.PublishSubscriber, logger log.Logger) *Worker {
-	return &Worker{
+type WorkerOption func(*Worker)
+
+// WithUpdateEvents makes the worker publish a DeviceUpdatedEvent to DeviceUpdatedTopic
+// whenever it saves a change to a device.
+func WithUpdateEvents() WorkerOption {
+	return func(w *Worker) {
+		w.updateEvents = true
+	}
+}
+
+func NewWorker(db DeviceWorkerStore, ps pubsub.PublishSubscriber, logger log.Logger, opts ...WorkerOption) *Worker {
+	w := &Worker{
 		db:     db,
 		ps:     ps,
 		logger: logger,
 	}
+	for _, opt := range opts {
+		opt(w)
+	}
+	return w
+}
+
+// DeviceUpdatedTopic is the topic of DeviceUpdatedEvent, see WithUpdateEvents.
+const DeviceUpdatedTopic = "mdm.DeviceUpdated"
+
+// DeviceUpdatedEvent reports the columns of a device changed by the worker, as returned by DiffFields.
+// A device saved for the first time reports every column it was saved with.
+type DeviceUpdatedEvent struct {
+	UUID          string   `json:"uuid"`
+	UDID          string   `json:"udid"`
+	SerialNumber  string   `json:"serial_number"`
+	ChangedFields []string `json:"changed_fields"`
+}
+
+// publishUpdate publishes the changes from before to dev, if update events are enabled and there are any.
+func (w *Worker) publishUpdate(ctx context.Context, before, dev *Device) error {
+	if !w.updateEvents {
+		return nil
+	}
+	changed := before.DiffFields(dev)
+	if len(changed) == 0 {
+		return nil
+	}
+	message, err := json.Marshal(DeviceUpdatedEvent{
+		UUID:          dev.UUID,
+		UDID:          dev.UDID,
+		SerialNumber:  dev.SerialNumber,
+		ChangedFields: changed,
+	})
+	if err != nil {
+		return errors.Wrap(err, "marshal device updated event")
+	}
+	err = w.ps.Publish(ctx, DeviceUpdatedTopic, message)
+	return errors.Wrapf(err, "publishing device updated event for device %s", dev.UUID)
 }
 
 func (w *Worker) Run(ctx context.Context) error {
@@ -112,6 +162,7 @@ func (w *Worker) updateFromDEPSync(ctx context.Context, message []byte) error {
 			)
 		}
 
+		before := *dev
 		if dev.UUID == "" {
 			dev.UUID = uuid.New().String()
 		}
@@ -123,13 +174,16 @@ func (w *Worker) updateFromDEPSync(ctx context.Context, message []byte) error {
 		dev.AssetTag = dd.AssetTag
 		dev.DEPProfileStatus = DEPProfileStatus(dd.ProfileStatus)
 		dev.DEPProfileUUID = dd.ProfileUUID
-		dev.DEPProfileAssignTime = dd.ProfileAssignTime
-		dev.DEPProfileAssignedDate = dd.DeviceAssignedDate
+		dev.DEPProfileAssignTime = optionalTime(dd.ProfileAssignTime)
+		dev.DEPProfileAssignedDate = optionalTime(dd.DeviceAssignedDate)
 		dev.DEPProfileAssignedBy = dd.DeviceAssignedBy
 
 		if err := w.db.Save(ctx, dev); err != nil {
 			return errors.Wrap(err, "save device %s from DEP sync")
 		}
+		if err := w.publishUpdate(ctx, &before, dev); err != nil {
+			return err
+		}
 	}
 
 	return nil
@@ -149,10 +203,13 @@ func (w *Worker) updateFromAcknowledge(ctx context.Context, message []byte) erro
 	if err != nil {
 		return errors.Wrapf(err, "retrieve device with udid %s", ev.Response.UDID)
 	}
+	before := *dev
 	dev.LastSeen = time.Now()
 
-	err = w.db.Save(ctx, dev)
-	return errors.Wrapf(err, "saving updated device for acknowledge event")
+	if err := w.db.Save(ctx, dev); err != nil {
+		return errors.Wrapf(err, "saving updated device for acknowledge event")
+	}
+	return w.publishUpdate(ctx, &before, dev)
 
 }
 
@@ -171,11 +228,17 @@ func (w *Worker) updateFromCheckout(ctx context.Context, message []byte) error {
 		return errors.Wrapf(err, "retrieve device with udid %s", ev.Command.UDID)
 	}
 
+	// a checked out device can no longer be woken with a push notification.
+	before := *dev
 	dev.Enrolled = false
+	dev.Token = ""
+	dev.PushMagic = ""
 	dev.LastSeen = time.Now()
 
-	err = w.db.Save(ctx, dev)
-	return errors.Wrapf(err, "saving updated device for checkout event")
+	if err := w.db.Save(ctx, dev); err != nil {
+		return errors.Wrapf(err, "saving updated device for checkout event")
+	}
+	return w.publishUpdate(ctx, &before, dev)
 
 }
 
@@ -194,6 +257,7 @@ func (w *Worker) updateFromTokenUpdate(ctx context.Context, message []byte) erro
 	if err != nil {
 		return errors.Wrapf(err, "retrieve device with udid %s", ev.Command.UDID)
 	}
+	before := *dev
 	dev.Token = ev.Command.Token.String()
 	dev.PushMagic = ev.Command.PushMagic
 	dev.UnlockToken = ev.Command.UnlockToken.String()
@@ -205,6 +269,9 @@ func (w *Worker) updateFromTokenUpdate(ctx context.Context, message []byte) erro
 	if err := w.db.Save(ctx, dev); err != nil {
 		return errors.Wrapf(err, "saving updated device for Token event udid=%s", ev.Command.UDID)
 	}
+	if err := w.publishUpdate(ctx, &before, dev); err != nil {
+		return err
+	}
 
 	if newlyEnrolled {
 		// notify subscribers of a successful enrollment
@@ -242,6 +309,10 @@ func (w *Worker) updateFromAuthenticate(ctx context.Context, message []byte) err
 		)
 	}
 
+	before := *device
+	if reenrolling {
+		device.Enrolled = false
+	}
 	if device.UUID == "" {
 		device.UUID = uuid.New().String()
 	}
@@ -256,18 +327,19 @@ func (w *Worker) updateFromAuthenticate(ctx context.Context, message []byte) err
 	device.Model = ev.Command.Model
 	device.ModelName = ev.Command.ModelName
 	device.LastSeen = time.Now()
-	err = w.db.Save(ctx, device)
-	return errors.Wrapf(err, "saving updated device for authenticate event")
+	if err := w.db.Save(ctx, device); err != nil {
+		return errors.Wrapf(err, "saving updated device for authenticate event")
+	}
+	return w.publishUpdate(ctx, &before, device)
 }
 
 func getOrCreateDevice(ctx context.Context, db DeviceWorkerStore, serial, udid string) (dev *Device, reenrolling bool, err error) {
 	if udid != "" {
 		// first try to fetch a device by UDID.
-		// If the device was previously enrolled it will exist.
-		// In case the device is known, set the enrolled status to false before returning.
+		// If the device was previously enrolled it will exist, and is returned as stored
+		// so that the caller can compare it with the re-enrolled device.
 		byUDID, err := db.DeviceByUDID(ctx, udid)
 		if err == nil {
-			byUDID.Enrolled = false
 			return byUDID, true, nil
 		}
 		if err != nil && !isNotFound(err) {
@@ -0,0 +1,187 @@
+package device
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+
+	"github.com/micromdm/micromdm/mdm"
+	"github.com/micromdm/micromdm/platform/pubsub"
+)
+
+func TestUpdateFromCheckout(t *testing.T) {
+	db := &memWorkerStore{devices: map[string]*Device{
+		"UDID-checkout": {
+			UUID:      "checkout",
+			UDID:      "UDID-checkout",
+			Token:     "abcdef",
+			PushMagic: "magic",
+			Enrolled:  true,
+		},
+	}}
+	w := NewWorker(db, nil, log.NewNopLogger())
+
+	message, err := mdm.MarshalCheckinEvent(&mdm.CheckinEvent{
+		Command: mdm.CheckinCommand{MessageType: "CheckOut", UDID: "UDID-checkout"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.updateFromCheckout(context.Background(), message); err != nil {
+		t.Fatal(err)
+	}
+
+	dev := db.devices["UDID-checkout"]
+	if dev.Enrolled {
+		t.Error("device is still enrolled after checkout")
+	}
+	if dev.Token != "" || dev.PushMagic != "" {
+		t.Errorf("push credentials not cleared: token=%q push_magic=%q", dev.Token, dev.PushMagic)
+	}
+	if dev.LastSeen.IsZero() {
+		t.Error("last seen not updated on checkout")
+	}
+
+	message, err = mdm.MarshalCheckinEvent(&mdm.CheckinEvent{
+		Command: mdm.CheckinCommand{MessageType: "CheckOut", UDID: "UDID-unknown"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.updateFromCheckout(context.Background(), message); err == nil {
+		t.Error("expected error checking out an unknown device")
+	}
+}
+
+func TestUpdateEvents(t *testing.T) {
+	db := &memWorkerStore{devices: map[string]*Device{
+		"UDID-events": {UUID: "events", UDID: "UDID-events", Token: "abcdef", PushMagic: "magic", Enrolled: true},
+	}}
+	ps := &recordingPubSub{}
+	w := NewWorker(db, ps, log.NewNopLogger(), WithUpdateEvents())
+
+	message, err := mdm.MarshalCheckinEvent(&mdm.CheckinEvent{
+		Command: mdm.CheckinCommand{MessageType: "CheckOut", UDID: "UDID-events"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.updateFromCheckout(context.Background(), message); err != nil {
+		t.Fatal(err)
+	}
+
+	if have, want := len(ps.published), 1; have != want {
+		t.Fatalf("have %d events, want %d", have, want)
+	}
+	if have, want := ps.published[0].topic, DeviceUpdatedTopic; have != want {
+		t.Errorf("have topic %s, want %s", have, want)
+	}
+	var ev DeviceUpdatedEvent
+	if err := json.Unmarshal(ps.published[0].msg, &ev); err != nil {
+		t.Fatal(err)
+	}
+	if have, want := ev.UUID, "events"; have != want {
+		t.Errorf("have uuid %s, want %s", have, want)
+	}
+	if have, want := strings.Join(ev.ChangedFields, ","), "push_magic,token,enrolled,last_seen"; have != want {
+		t.Errorf("have changed fields %s, want %s", have, want)
+	}
+
+	// without the option, no events are published.
+	ps.published = nil
+	w = NewWorker(db, ps, log.NewNopLogger())
+	if err := w.updateFromCheckout(context.Background(), message); err != nil {
+		t.Fatal(err)
+	}
+	if len(ps.published) != 0 {
+		t.Errorf("published %d events without WithUpdateEvents", len(ps.published))
+	}
+}
+
+func TestUpdateEventsReenrolling(t *testing.T) {
+	db := &memWorkerStore{devices: map[string]*Device{
+		"UDID-reenroll": {UUID: "reenroll", UDID: "UDID-reenroll", SerialNumber: "C02REENROLL", OSVersion: "10.15.3", Enrolled: true},
+	}}
+	ps := &recordingPubSub{}
+	w := NewWorker(db, ps, log.NewNopLogger(), WithUpdateEvents())
+
+	auth := mdm.CheckinCommand{MessageType: "Authenticate", UDID: "UDID-reenroll"}
+	auth.SerialNumber = "C02REENROLL"
+	auth.OSVersion = "10.15.3"
+	message, err := mdm.MarshalCheckinEvent(&mdm.CheckinEvent{Command: auth})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.updateFromAuthenticate(context.Background(), message); err != nil {
+		t.Fatal(err)
+	}
+
+	if db.devices["UDID-reenroll"].Enrolled {
+		t.Error("re-authenticated device is still enrolled")
+	}
+	if have, want := len(ps.published), 1; have != want {
+		t.Fatalf("have %d events, want %d", have, want)
+	}
+	var ev DeviceUpdatedEvent
+	if err := json.Unmarshal(ps.published[0].msg, &ev); err != nil {
+		t.Fatal(err)
+	}
+	if have, want := strings.Join(ev.ChangedFields, ","), "enrolled,last_seen"; have != want {
+		t.Errorf("have changed fields %s, want %s", have, want)
+	}
+}
+
+// recordingPubSub records the messages published to it.
+type recordingPubSub struct {
+	published []struct {
+		topic string
+		msg   []byte
+	}
+}
+
+func (ps *recordingPubSub) Publish(ctx context.Context, topic string, msg []byte) error {
+	ps.published = append(ps.published, struct {
+		topic string
+		msg   []byte
+	}{topic, msg})
+	return nil
+}
+
+func (ps *recordingPubSub) Subscribe(ctx context.Context, name, topic string) (<-chan pubsub.Event, error) {
+	return make(chan pubsub.Event), nil
+}
+
+// memWorkerStore is a DeviceWorkerStore keyed by UDID.
+type memWorkerStore struct {
+	devices map[string]*Device
+}
+
+func (s *memWorkerStore) Save(ctx context.Context, d *Device) error {
+	s.devices[d.UDID] = d
+	return nil
+}
+
+func (s *memWorkerStore) DeviceByUDID(ctx context.Context, udid string) (*Device, error) {
+	dev, ok := s.devices[udid]
+	if !ok {
+		return nil, memNotFoundErr{}
+	}
+	return dev, nil
+}
+
+func (s *memWorkerStore) DeviceBySerial(ctx context.Context, serial string) (*Device, error) {
+	for _, dev := range s.devices {
+		if dev.SerialNumber == serial {
+			return dev, nil
+		}
+	}
+	return nil, memNotFoundErr{}
+}
+
+type memNotFoundErr struct{}
+
+func (memNotFoundErr) Error() string  { return "device not found" }
+func (memNotFoundErr) NotFound() bool { return true }